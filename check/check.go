@@ -0,0 +1,205 @@
+package check
+
+import (
+	"context"
+	"fmt"
+	"net"
+	nethttp "net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/mdouchement/ergo/resolver"
+	"github.com/mdouchement/ergo/server"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+type controler struct {
+	config string
+	dest   string
+	user   string
+	method string
+}
+
+// Command is used to validate the configuration and test destinations.
+func Command() *cobra.Command {
+	ctrl := &controler{}
+
+	c := &cobra.Command{
+		Use:   "check",
+		Short: "Validates the configuration and tests destinations",
+		Args:  cobra.ExactArgs(0),
+		// Errors are the result of the check
+		SilenceUsage: true,
+		RunE: func(_ *cobra.Command, _ []string) error {
+			ctrl.config = server.ConfigFile(ctrl.config)
+
+			config, err := ctrl.validate()
+			if err != nil {
+				return err
+			}
+
+			if ctrl.dest == "" {
+				return nil
+			}
+
+			return ctrl.check(config)
+		},
+	}
+	c.Flags().StringVarP(&ctrl.config, "config", "c", os.Getenv("ERGO_PROXY_CONFIG"), "Server's configuration")
+	c.Flags().StringVarP(&ctrl.dest, "dest", "d", "", "Destination to test (host:port or URL)")
+	c.Flags().StringVarP(&ctrl.user, "user", "u", "", "User performing the request")
+	c.Flags().StringVarP(&ctrl.method, "method", "X", "", "Method of the request (default CONNECT for host:port and GET for http URLs)")
+
+	return c
+}
+
+// validate parses strictly the configuration and reports the invalid rules.
+func (ctrl *controler) validate() (server.Config, error) {
+	config, err := server.LoadConfig(ctrl.config, true)
+	if err != nil {
+		return config, err
+	}
+
+	errs, err := server.ValidateRules(ctrl.config)
+	if err != nil {
+		return config, err
+	}
+
+	if len(config.DenyLists) > 0 {
+		lists, err := resolver.NewListLoader(config.DenyLists, config.DenyListsCache).Load(context.Background())
+		if err != nil {
+			return config, errors.Wrap(err, "could not load deny lists")
+		}
+
+		for _, list := range lists {
+			errs = append(errs, resolver.ValidateRules(list.Name, list.Rules)...)
+		}
+	}
+
+	for _, err := range errs {
+		fmt.Println(err)
+	}
+	if len(errs) > 0 {
+		return config, errors.Errorf("%d invalid rules", len(errs))
+	}
+
+	if ctrl.config == "" {
+		fmt.Println("Configuration from environment is valid")
+	} else {
+		fmt.Printf("Configuration %s is valid\n", ctrl.config)
+	}
+	return config, nil
+}
+
+// check reports whether the destination would be allowed, it returns an error when it would not.
+func (ctrl *controler) check(config server.Config) error {
+	req, err := ctrl.request()
+	if err != nil {
+		return err
+	}
+
+	// Normalized as the server does, so the matching rules are the ones applied by the check
+	req.Host, err = resolver.NormalizeHost(req.Host)
+	if err != nil {
+		return errors.Wrapf(err, "invalid destination %s", ctrl.dest)
+	}
+
+	config.MITM = nil // Avoid generating the CA
+	srv, err := server.New(config)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Destination: %s %s", req.Method, net.JoinHostPort(req.Host, req.Port))
+	if req.URL != "" {
+		fmt.Printf(" (%s)", req.URL)
+	}
+	if req.User != "" {
+		fmt.Printf(" as %s", req.User)
+	}
+	fmt.Println()
+
+	if names, ok := srv.Resolver.(*resolver.NameResolver); ok {
+		for _, rule := range names.MatchingRules(req.Host) {
+			fmt.Println("Matching rule:", rule)
+		}
+	}
+
+	result, err := srv.Check(context.Background(), req)
+	if err != nil {
+		var rejected *resolver.RejectedError
+		if errors.As(err, &rejected) {
+			fmt.Println("Rejected:", rejected)
+			return errors.New("destination rejected")
+		}
+		return errors.Wrap(err, "destination check failed")
+	}
+
+	fmt.Println("Allowed:", result.IP)
+	for _, rule := range result.Rules {
+		fmt.Println("Allowed by:", rule)
+	}
+	for _, rejected := range result.Monitored {
+		fmt.Println("Monitored:", rejected)
+	}
+	if len(result.CNAMEs) > 0 {
+		fmt.Println("Canonical names:", strings.Join(result.CNAMEs, " -> "))
+	}
+	if len(result.IPs) > 1 {
+		fmt.Println("Addresses:", result.IPs)
+	}
+	return nil
+}
+
+func (ctrl *controler) request() (server.Request, error) {
+	req := server.Request{
+		User:   ctrl.user,
+		Method: strings.ToUpper(ctrl.method),
+		Header: nethttp.Header{},
+	}
+
+	if !strings.Contains(ctrl.dest, "://") {
+		host, port, err := net.SplitHostPort(ctrl.dest)
+		if err != nil {
+			return req, errors.Wrapf(err, "invalid destination %s", ctrl.dest)
+		}
+
+		req.Host = host
+		req.Port = port
+		if req.Method == "" {
+			req.Method = "CONNECT"
+		}
+		return req, nil
+	}
+
+	u, err := url.Parse(ctrl.dest)
+	if err != nil {
+		return req, errors.Wrapf(err, "invalid destination %s", ctrl.dest)
+	}
+
+	req.Host = u.Hostname()
+	req.Port = u.Port()
+	switch u.Scheme {
+	case "http":
+		if req.Port == "" {
+			req.Port = "80"
+		}
+		if req.Method == "" {
+			req.Method = "GET"
+		}
+		req.URL = u.String()
+	case "https":
+		if req.Port == "" {
+			req.Port = "443"
+		}
+		if req.Method == "" {
+			req.Method = "CONNECT"
+		}
+	default:
+		return req, errors.Errorf("unsupported scheme %s", u.Scheme)
+	}
+
+	return req, nil
+}
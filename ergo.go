@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 
+	"github.com/mdouchement/ergo/check"
 	"github.com/mdouchement/ergo/forwarder"
 	"github.com/mdouchement/ergo/server"
 	"github.com/spf13/cobra"
@@ -16,6 +17,7 @@ func main() {
 	}
 	c.AddCommand(server.Command())
 	c.AddCommand(forwarder.Command())
+	c.AddCommand(check.Command())
 
 	if err := c.Execute(); err != nil {
 		log.Fatalf("%+v", err)
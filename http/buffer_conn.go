@@ -39,6 +39,11 @@ func (b *BufferConn) Read(p []byte) (n int, err error) {
 	return b.Reader.Read(p)
 }
 
+// NetConn returns the wrapped connection, it can be read directly once WriteBuffered emptied the buffer.
+func (b *BufferConn) NetConn() net.Conn {
+	return b.Conn
+}
+
 func (b *BufferConn) Write(p []byte) (n int, err error) {
 	return b.Conn.Write(p)
 }
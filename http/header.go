@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/base64"
 	"fmt"
+	"net"
 	"net/http"
 	"strings"
 
@@ -52,6 +53,9 @@ func Parse(r Reader) (h Header, err error) {
 		}
 
 		idx := bytes.Index(s, []byte{':'})
+		if idx < 0 {
+			return h, errors.Errorf("malformed HTTP header %s", s)
+		}
 		h.Header.Set(
 			string(bytes.TrimSpace(s[:idx])),
 			string(bytes.TrimSpace(s[idx+1:])),
@@ -83,36 +87,66 @@ func (h *Header) ProxyBasicAuth() (user, password string, ok bool) {
 	return cs[:s], cs[s+1:], true
 }
 
+// Domain returns the host of the Host header without its port, an IPv6 is returned without its brackets.
 func (h *Header) Domain() string {
-	host := h.Header.Get("Host")
-	idx := strings.Index(host, ":")
-	if idx < 1 {
-		return host
-	}
-	return host[:idx]
+	domain, _ := h.splitHost()
+	return domain
 }
 
 func (h *Header) Host() string {
 	host := h.Header.Get("Host")
-	if host != "" && !strings.Contains(host, ":") {
-		host += ":80"
+	if _, port := h.splitHost(); host != "" && port == "" {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), "80")
 	}
 	return host
 }
 
 func (h *Header) Port() string {
-	host := h.Header.Get("Host")
-	idx := strings.Index(host, ":")
-	if idx < 1 {
+	_, port := h.splitHost()
+	if port == "" {
 		return "80"
 	}
-	return host[idx+1:]
+	return port
+}
+
+// splitHost splits the Host header into its host and its port, the port is empty when it is not given.
+func (h *Header) splitHost() (host, port string) {
+	host = h.Header.Get("Host")
+	if domain, port, err := net.SplitHostPort(host); err == nil {
+		return domain, port
+	}
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1], ""
+	}
+	return host, ""
+}
+
+// URL returns the absolute URL of the request.
+func (h *Header) URL() string {
+	if strings.HasPrefix(h.RequestURI, "http://") || strings.HasPrefix(h.RequestURI, "https://") {
+		return h.RequestURI
+	}
+	return "http://" + h.Header.Get("Host") + h.RequestURI
 }
 
 func (h *Header) String() string {
 	return h.format(nil).String()
 }
 
+// forward returns the header sent to the remote without proxy details.
+// The remote is asked to close the connection after the response so each request
+// of the client goes through the proxy checks.
+func (h *Header) forward() []byte {
+	fh := *h
+	fh.Header = h.Header.Clone()
+	for k := range hopHeaders {
+		fh.Header.Del(k)
+	}
+	fh.Header.Set("Connection", "close")
+
+	return fh.format(nil).Bytes()
+}
+
 func (h *Header) format(exclude map[string]bool) *bytes.Buffer {
 	b := bytes.NewBuffer(nil)
 	b.WriteString(fmt.Sprintf("%s %s %s\r\n", h.Method, h.RequestURI, h.Proto))
@@ -22,7 +22,7 @@ func Proxy(c net.Conn) (net.Conn, Header, error) {
 		}
 	} else {
 		// We write the header without proxy details.
-		buf.Prepend(header.format(hopHeaders).Bytes())
+		buf.Prepend(header.forward())
 	}
 
 	return buf, header, nil
@@ -12,6 +12,7 @@ type (
 		Prepend(p []byte)
 		IsAllRead() bool
 		Reset()
+		WriteBuffered(w io.Writer) (int64, error)
 	}
 
 	reader struct {
@@ -102,6 +103,20 @@ func (r *reader) Reset() {
 	r.offset = 0
 }
 
+// WriteBuffered writes the buffered bytes not read yet to w and empties the buffer.
+func (r *reader) WriteBuffered(w io.Writer) (int64, error) {
+	if r.buf == nil {
+		return 0, nil
+	}
+
+	n, err := w.Write(r.buf[r.offset:r.size])
+	r.offset += n
+	if r.offset >= r.size {
+		r.Reset()
+	}
+	return int64(n), err
+}
+
 func (r *reader) Read(p []byte) (n int, err error) {
 	if r.buf == nil {
 		return r.r.Read(p)
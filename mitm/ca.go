@@ -0,0 +1,178 @@
+package mitm
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/pkg/errors"
+)
+
+const (
+	// CAValidity is the validity duration of a generated CA.
+	CAValidity = 10 * 365 * 24 * time.Hour
+	// LeafValidity is the validity duration of the minted leaf certificates.
+	LeafValidity = 7 * 24 * time.Hour
+	// LeafCacheTTL is the duration before a minted leaf certificate is evicted from the cache.
+	LeafCacheTTL = 24 * time.Hour
+)
+
+// A CA is a certificate authority used to mint leaf certificates on the fly.
+type CA struct {
+	cert  *x509.Certificate
+	key   crypto.Signer
+	leaf  crypto.Signer
+	cache *ristretto.Cache[string, *tls.Certificate]
+}
+
+// LoadOrCreateCA loads the CA from the given PEM files.
+// The CA is generated and written to these files when they do not exist.
+func LoadOrCreateCA(certfile, keyfile string) (*CA, error) {
+	_, err := os.Stat(certfile)
+	if os.IsNotExist(err) {
+		err = createCA(certfile, keyfile)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "ca")
+	}
+
+	pair, err := tls.LoadX509KeyPair(certfile, keyfile)
+	if err != nil {
+		return nil, errors.Wrap(err, "ca: could not load key pair")
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "ca: could not parse certificate")
+	}
+	if !cert.IsCA {
+		return nil, errors.Errorf("ca: %s is not a CA certificate", certfile)
+	}
+
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("ca: unsupported private key")
+	}
+
+	leaf, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "ca: could not generate leaf key")
+	}
+
+	cache, err := ristretto.NewCache(&ristretto.Config[string, *tls.Certificate]{
+		NumCounters: 10_000,
+		MaxCost:     1000,
+		BufferItems: 64,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "ca")
+	}
+
+	return &CA{
+		cert:  cert,
+		key:   key,
+		leaf:  leaf,
+		cache: cache,
+	}, nil
+}
+
+// Certificate returns a certificate for the given host signed by the CA.
+func (ca *CA) Certificate(host string) (*tls.Certificate, error) {
+	if cert, ok := ca.cache.Get(host); ok {
+		return cert, nil
+	}
+
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: host},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(LeafValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if template.NotAfter.After(ca.cert.NotAfter) {
+		template.NotAfter = ca.cert.NotAfter
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, ca.leaf.Public(), ca.key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "ca: could not mint certificate for %s", host)
+	}
+
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, ca.cert.Raw},
+		PrivateKey:  ca.leaf,
+	}
+
+	ca.cache.SetWithTTL(host, cert, 1, LeafCacheTTL)
+	return cert, nil
+}
+
+func createCA(certfile, keyfile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return errors.Wrap(err, "could not generate key")
+	}
+
+	serial, err := serialNumber()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Ergo Proxy CA", Organization: []string{"Ergo"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(CAValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return errors.Wrap(err, "could not create certificate")
+	}
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal key")
+	}
+
+	err = os.WriteFile(keyfile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), 0600)
+	if err != nil {
+		return errors.Wrap(err, "could not write key")
+	}
+
+	err = os.WriteFile(certfile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	return errors.Wrap(err, "could not write certificate")
+}
+
+func serialNumber() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return serial, errors.Wrap(err, "could not generate serial number")
+}
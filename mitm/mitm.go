@@ -0,0 +1,306 @@
+package mitm
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/urlfilter"
+	"github.com/AdguardTeam/urlfilter/filterlist"
+	"github.com/pkg/errors"
+)
+
+// A Config holds the settings of the TLS interception.
+type Config struct {
+	// CACert is the PEM file of the CA certificate. It is generated when it does not exist.
+	CACert string `yaml:"ca_cert"`
+	// CAKey is the PEM file of the CA private key. It is generated when it does not exist.
+	CAKey string `yaml:"ca_key"`
+	// Domains is the list of urlfilter patterns of the intercepted hosts.
+	// All hosts are intercepted when empty.
+	Domains []string `yaml:"domains" env:"lines"`
+	// Bypass is the list of urlfilter patterns of the hosts that are never intercepted (e.g. pinned apps).
+	Bypass []string `yaml:"bypass" env:"lines"`
+}
+
+type (
+	// An Interceptor terminates the client TLS connections and forwards their HTTP requests
+	// to the upstreams over verified TLS connections.
+	Interceptor struct {
+		ca      *CA
+		domains *urlfilter.DNSEngine
+		bypass  *urlfilter.DNSEngine
+	}
+
+	// A Session holds the hooks used to intercept one CONNECT tunnel.
+	Session struct {
+		// Host is the host requested by the CONNECT request.
+		// It is used when the client does not send a server name.
+		Host string
+		// Address is the host:port requested by the CONNECT request.
+		// When set, the requests are always relayed to it whatever their Host header.
+		Address string
+		// Dial opens the TCP connection to the upstream of the given address.
+		Dial func(ctx context.Context, network, address string) (net.Conn, error)
+		// Filter returns an error when the request must be rejected.
+		Filter func(r *http.Request) error
+		// Reject responds to a request rejected by Filter (403 Forbidden by default).
+		Reject func(w http.ResponseWriter, r *http.Request, err error)
+		// Log is called once the request has been handled.
+		Log func(r *http.Request, status int, err error)
+	}
+)
+
+// New returns a new Interceptor.
+func New(config Config) (*Interceptor, error) {
+	ca, err := LoadOrCreateCA(config.CACert, config.CAKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "mitm")
+	}
+
+	i := &Interceptor{ca: ca}
+
+	if len(config.Domains) > 0 {
+		i.domains, err = engine(config.Domains)
+		if err != nil {
+			return nil, errors.Wrap(err, "mitm: domains")
+		}
+	}
+
+	i.bypass, err = engine(config.Bypass)
+	if err != nil {
+		return nil, errors.Wrap(err, "mitm: bypass")
+	}
+
+	return i, nil
+}
+
+// Match returns true if the given host must be intercepted.
+func (i *Interceptor) Match(host string) bool {
+	if rules, ok := i.bypass.Match(host); ok && !isAllowlisted(rules) {
+		return false
+	}
+	if i.domains == nil {
+		return true
+	}
+
+	rules, ok := i.domains.Match(host)
+	return ok && !isAllowlisted(rules)
+}
+
+// Intercept performs the TLS handshake with the client of c and relays its requests
+// until the connection is closed.
+func (i *Interceptor) Intercept(ctx context.Context, c net.Conn, session *Session) error {
+	sc := tls.Server(c, &tls.Config{
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = session.Host
+			}
+			return i.ca.Certificate(name)
+		},
+	})
+	if err := sc.HandshakeContext(ctx); err != nil {
+		return errors.Wrap(err, "mitm: client handshake")
+	}
+	defer sc.Close()
+
+	transport := &http.Transport{
+		DialContext:           session.Dial,
+		TLSClientConfig:       &tls.Config{NextProtos: []string{"http/1.1"}},
+		TLSHandshakeTimeout:   10 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConnsPerHost:   4,
+	}
+	defer transport.CloseIdleConnections()
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL.Scheme = "https"
+			r.Out.URL.Host = r.In.URL.Host
+			r.Out.Host = r.In.Host
+		},
+		Transport: transport,
+	}
+
+	l := newConnListener(sc)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.URL.Scheme = "https"
+			r.URL.Host = r.Host
+			if session.Address != "" {
+				r.URL.Host = session.Address
+			}
+
+			if session.Filter != nil {
+				if err := session.Filter(r); err != nil {
+					session.reject(w, r, err)
+					session.log(r, http.StatusForbidden, err)
+					return
+				}
+			}
+
+			rw := &responseWriter{ResponseWriter: w}
+			var perr error
+			p := *proxy
+			p.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+				perr = err
+				w.WriteHeader(http.StatusBadGateway)
+			}
+			p.ServeHTTP(rw, r)
+			session.log(r, rw.status, perr)
+		}),
+		ReadHeaderTimeout: 30 * time.Second,
+		IdleTimeout:       90 * time.Second,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			srv.Close()
+		case <-l.done:
+		}
+	}()
+
+	err := srv.Serve(l)
+	if errors.Is(err, errListenerDone) || errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return errors.Wrap(err, "mitm")
+}
+
+func (s *Session) reject(w http.ResponseWriter, r *http.Request, err error) {
+	if s.Reject != nil {
+		s.Reject(w, r, err)
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+}
+
+func (s *Session) log(r *http.Request, status int, err error) {
+	if s.Log != nil {
+		s.Log(r, status, err)
+	}
+}
+
+//
+//
+//
+
+func engine(patterns []string) (*urlfilter.DNSEngine, error) {
+	rs, err := filterlist.NewRuleStorage([]filterlist.Interface{
+		filterlist.NewString(&filterlist.StringConfig{
+			ID:        1,
+			RulesText: strings.Join(patterns, "\n"),
+		}),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return urlfilter.NewDNSEngine(rs), nil
+}
+
+func isAllowlisted(rules *urlfilter.DNSResult) bool {
+	return rules.NetworkRule != nil && rules.NetworkRule.Whitelist
+}
+
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+//
+//
+//
+
+var errListenerDone = errors.New("listener done")
+
+// connListener is a net.Listener that accepts only one connection.
+type connListener struct {
+	mu   sync.Mutex
+	c    net.Conn
+	done chan struct{}
+}
+
+func newConnListener(c net.Conn) *connListener {
+	l := &connListener{done: make(chan struct{})}
+	l.c = &notifyConn{Conn: c, close: l.Close}
+	return l
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	c := l.c
+	l.c = nil
+	l.mu.Unlock()
+
+	if c != nil {
+		return c, nil
+	}
+
+	<-l.done
+	return nil, errListenerDone
+}
+
+func (l *connListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	select {
+	case <-l.done:
+	default:
+		close(l.done)
+	}
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return dummyAddr{}
+}
+
+type dummyAddr struct{}
+
+func (dummyAddr) Network() string { return "tcp" }
+func (dummyAddr) String() string  { return "mitm" }
+
+// notifyConn closes its listener once the connection is closed.
+type notifyConn struct {
+	net.Conn
+	once  sync.Once
+	close func() error
+}
+
+func (c *notifyConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() { c.close() })
+	return err
+}
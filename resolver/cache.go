@@ -0,0 +1,214 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/ristretto/v2"
+	"github.com/pkg/errors"
+)
+
+// A CacheConfig holds the settings of a Cache.
+// The yaml tags are the keys of the configuration file of the server.
+type CacheConfig struct {
+	// MinTTL is the minimum duration a resolution is cached, whatever its DNS TTL.
+	MinTTL time.Duration `yaml:"cache_min_ttl"`
+	// MaxTTL is the maximum duration a resolution is cached, whatever its DNS TTL (CacheTTL by default).
+	MaxTTL time.Duration `yaml:"cache_max_ttl"`
+	// Size is the maximum number of resolutions kept in the cache (DefaultCacheSize by default).
+	Size int `yaml:"cache_size"`
+	// ServeStale is the duration an expired resolution is still served while it is resolved again
+	// in the background. Disabled when zero.
+	ServeStale time.Duration `yaml:"cache_serve_stale"`
+	// NegativeTTL is the maximum duration an unknown domain name is cached (DefaultNegativeTTL by default).
+	// The SOA of the DNS answer gives the duration when it is lower.
+	NegativeTTL time.Duration `yaml:"negative_cache_ttl"`
+	// NegativeSize is the maximum number of rejected and unknown domain names kept in the cache
+	// (DefaultNegativeCacheSize by default).
+	NegativeSize int `yaml:"negative_cache_size"`
+	// PrefetchHits is the number of hits making a resolution resolved again shortly before it expires
+	// (during the last tenth of its TTL). Disabled when zero.
+	PrefetchHits int `yaml:"cache_prefetch_hits"`
+}
+
+// A Cache caches the resolutions for their TTL, the domain names rejected by their IPs and the unknown ones.
+// The concurrent resolutions of a name are coalesced and cancelled when all their contexts are done.
+type Cache struct {
+	config       CacheConfig
+	positive     *ristretto.Cache[string, *cacheEntry]
+	negative     *ristretto.Cache[string, error]
+	names        sync.Map // Names of the positive cache, used by the snapshots
+	flights      flights
+	revalidating sync.Map
+}
+
+type cacheEntry struct {
+	result  *Result
+	ttl     time.Duration
+	expires time.Time
+	hits    atomic.Int64
+}
+
+// NewCache returns a new Cache.
+func NewCache(config CacheConfig) (*Cache, error) {
+	if config.MaxTTL <= 0 {
+		config.MaxTTL = CacheTTL
+	}
+	if config.MinTTL > config.MaxTTL {
+		return nil, errors.Errorf("cache min TTL %s is greater than max TTL %s", config.MinTTL, config.MaxTTL)
+	}
+	if config.Size <= 0 {
+		config.Size = DefaultCacheSize
+	}
+	if config.NegativeTTL <= 0 {
+		config.NegativeTTL = DefaultNegativeTTL
+	}
+	if config.NegativeSize <= 0 {
+		config.NegativeSize = DefaultNegativeCacheSize
+	}
+
+	positive, err := ristretto.NewCache(&ristretto.Config[string, *cacheEntry]{
+		NumCounters: 10 * int64(config.Size),
+		MaxCost:     int64(config.Size),
+		BufferItems: 64,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	negative, err := ristretto.NewCache(&ristretto.Config[string, error]{
+		NumCounters: 10 * int64(config.NegativeSize),
+		MaxCost:     int64(config.NegativeSize),
+		BufferItems: 64,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cache{
+		config:   config,
+		positive: positive,
+		negative: negative,
+	}, nil
+}
+
+// Middleware returns the layer caching the resolutions of the next resolver.
+func (c *Cache) Middleware(next Resolver) Resolver {
+	resolve := func(ctx context.Context, name string) (*Result, error) {
+		result, err := next.Resolve(ctx, name)
+
+		var cacheable *cacheableError
+		if errors.As(err, &cacheable) {
+			err = cacheable.error
+			c.setNegative(name, err, cacheable.ttl)
+			return nil, err
+		}
+		if err == nil {
+			c.set(result)
+		}
+		return result, err
+	}
+
+	return ResolverFunc(func(ctx context.Context, name string) (*Result, error) {
+		if entry, ok := c.positive.Get(name); ok {
+			now := time.Now()
+			switch {
+			case now.Before(entry.expires):
+				if c.prefetch(entry, now) {
+					c.revalidate(name, resolve)
+				}
+				return entry.result.with(CacheHit), nil
+			case c.config.ServeStale > 0:
+				c.revalidate(name, resolve)
+				return entry.result.with(CacheStale), nil
+			}
+		}
+
+		if err, ok := c.negative.Get(name); ok {
+			return nil, err
+		}
+
+		return c.flights.do(ctx, name, resolve)
+	})
+}
+
+// Flush clears the cached resolutions.
+func (c *Cache) Flush() {
+	c.positive.Clear()
+	c.negative.Clear()
+	c.names.Clear()
+}
+
+// prefetch counts the hit and returns true when the resolution is hot and is about to expire.
+func (c *Cache) prefetch(entry *cacheEntry, now time.Time) bool {
+	hits := entry.hits.Add(1)
+	return c.config.PrefetchHits > 0 && hits >= int64(c.config.PrefetchHits) && entry.expires.Sub(now) < entry.ttl/10
+}
+
+// set caches the resolution for its TTL clamped by the min and max TTLs of the configuration.
+func (c *Cache) set(result *Result) {
+	ttl := c.ttl(result.TTL)
+	if ttl <= 0 {
+		return // A zero TTL means no expiration for ristretto
+	}
+
+	c.store(&cacheEntry{result: result, ttl: ttl, expires: time.Now().Add(ttl)})
+}
+
+func (c *Cache) store(entry *cacheEntry) {
+	ttl := time.Until(entry.expires) + max(c.config.ServeStale, 0)
+	if ttl <= 0 {
+		return
+	}
+
+	c.positive.SetWithTTL(entry.result.Name, entry, 1, ttl)
+	c.positive.Wait()
+	c.names.Store(entry.result.Name, struct{}{})
+}
+
+// setNegative caches the rejection or the resolution failure of the given name.
+// A domain name rejected by its IP is cached until its resolution expires,
+// an unknown domain name for the negative TTL.
+func (c *Cache) setNegative(name string, err error, ttl time.Duration) {
+	var rejected *RejectedError
+	if errors.As(err, &rejected) {
+		cached := *rejected
+		cached.Kind = "cached " + cached.Kind
+		err, ttl = &cached, c.ttl(ttl)
+	} else if ttl <= 0 {
+		ttl = c.config.NegativeTTL
+	} else {
+		ttl = min(ttl, c.config.NegativeTTL)
+	}
+
+	if ttl <= 0 {
+		return // A zero TTL means no expiration for ristretto
+	}
+
+	c.negative.SetWithTTL(name, err, 1, ttl)
+	c.negative.Wait()
+}
+
+func (c *Cache) ttl(ttl time.Duration) time.Duration {
+	return min(max(ttl, c.config.MinTTL), c.config.MaxTTL)
+}
+
+// revalidate resolves again the given name in the background.
+// The entry is removed when the name is rejected or unknown, it is kept on other failures (e.g. timeouts).
+func (c *Cache) revalidate(name string, resolve func(context.Context, string) (*Result, error)) {
+	if _, loaded := c.revalidating.LoadOrStore(name, struct{}{}); loaded {
+		return
+	}
+
+	go func() {
+		defer c.revalidating.Delete(name)
+
+		_, err := c.flights.do(context.Background(), name, resolve)
+		if dnserr := new(net.DNSError); errors.Is(err, ErrHostRejected) || errors.As(err, &dnserr) && dnserr.IsNotFound {
+			c.positive.Del(name)
+		}
+	}()
+}
@@ -0,0 +1,88 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestNegativeCache(t *testing.T) {
+	notFound := &net.DNSError{Err: "no such host", Name: "missing.test", IsNotFound: true}
+	rejected := &RejectedError{Kind: "ip", Rule: "||192.0.2.1^", Target: "rejected.test"}
+
+	tests := []struct {
+		name      string
+		err       error // Returned by the next resolver
+		cacheable bool
+		ttl       time.Duration
+		wait      time.Duration
+		cached    bool // Still cached after wait
+		kind      string
+	}{
+		{name: "not found", err: notFound, cacheable: true, ttl: 30 * time.Second, wait: 200 * time.Millisecond},
+		{name: "not found without SOA", err: notFound, cacheable: true, cached: true},
+		{name: "not found expired", err: notFound, cacheable: true, ttl: 50 * time.Millisecond, wait: 75 * time.Millisecond},
+		{name: "rejected", err: rejected, cacheable: true, ttl: time.Minute, wait: 200 * time.Millisecond, cached: true, kind: "cached ip"},
+		{name: "rejected expired", err: rejected, cacheable: true, ttl: 50 * time.Millisecond, wait: 75 * time.Millisecond},
+		{name: "failure", err: errors.New("i/o timeout")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache, err := NewCache(CacheConfig{NegativeTTL: 100 * time.Millisecond})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var calls atomic.Int64
+			r := cache.Middleware(ResolverFunc(func(ctx context.Context, name string) (*Result, error) {
+				calls.Add(1)
+				if tt.cacheable {
+					return nil, &cacheableError{error: tt.err, ttl: tt.ttl}
+				}
+				return nil, tt.err
+			}))
+			resolve := func(expected int64) error {
+				t.Helper()
+
+				_, err := r.Resolve(context.Background(), "host.test")
+				if err == nil {
+					t.Fatal("error expected")
+				}
+				if n := calls.Load(); n != expected {
+					t.Errorf("%d resolutions, expected %d", n, expected)
+				}
+				return err
+			}
+
+			if err := resolve(1); !errors.Is(err, tt.err) {
+				t.Fatalf("error = %v, expected %v", err, tt.err)
+			}
+
+			expected := int64(1)
+			if !tt.cacheable {
+				expected++
+			}
+			err = resolve(expected)
+			var rejection *RejectedError
+			if tt.kind != "" && (!errors.As(err, &rejection) || rejection.Kind != tt.kind) {
+				t.Errorf("error = %v, expected a %s rejection", err, tt.kind)
+			}
+
+			// The not found names are cached for the negative TTL at most, the rejections for their TTL
+			time.Sleep(tt.wait)
+			if !tt.cached {
+				expected++
+			}
+			resolve(expected)
+
+			// A flush forgets the cached failures
+			cache.Flush()
+			resolve(expected + 1)
+		})
+	}
+}
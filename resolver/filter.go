@@ -0,0 +1,263 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// A Filter checks the domain names against the policy and their IPs against the blocked networks and the deny list.
+// Its lists can be replaced while it is used.
+type Filter struct {
+	config  Config
+	blocked networks
+
+	update  sync.Mutex // Serializes the updates of the lists
+	lists   []List
+	runtime []string
+
+	mu      sync.Mutex
+	filters *filters
+}
+
+// NewFilter returns a new Filter for the policy, the lists and the blocked networks of the given configuration.
+func NewFilter(config Config) (*Filter, error) {
+	switch config.Policy {
+	case "":
+		config.Policy = PolicyDenyList
+	case PolicyDenyList, PolicyAllowList:
+	default:
+		return nil, errors.Errorf("unsupported policy: %q", config.Policy)
+	}
+
+	f, err := newFilters(config, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	cidrs := config.BlockedNetworks
+	if config.BlockPrivate {
+		cidrs = append(PrivateNetworks[:len(PrivateNetworks):len(PrivateNetworks)], cidrs...)
+	}
+	blocked, err := parseNetworks(cidrs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Filter{
+		config:  config,
+		blocked: blocked,
+		filters: f,
+	}, nil
+}
+
+// SetLists replaces the deny lists loaded in addition of the deny list of the configuration.
+func (f *Filter) SetLists(lists []List) error {
+	f.update.Lock()
+	defer f.update.Unlock()
+
+	return f.build(lists, f.runtime)
+}
+
+// SetRuntimeRules replaces the deny rules added at runtime in addition of the deny lists.
+// They are never in monitor mode.
+func (f *Filter) SetRuntimeRules(rules []string) error {
+	f.update.Lock()
+	defer f.update.Unlock()
+
+	return f.build(f.lists, rules)
+}
+
+func (f *Filter) build(lists []List, runtime []string) error {
+	all := lists
+	if len(runtime) > 0 {
+		all = append(lists[:len(lists):len(lists)], List{
+			ID:    RuntimeListID,
+			Name:  "runtime",
+			Rules: []byte(strings.Join(runtime, "\n")),
+		})
+	}
+
+	filters, err := newFilters(f.config, all)
+	if err != nil {
+		return err
+	}
+
+	f.lists, f.runtime = lists, runtime
+	f.mu.Lock()
+	f.filters = filters
+	f.mu.Unlock()
+	return nil
+}
+
+// Names returns the layer checking the domain names against the policy before calling the next resolver.
+// The $dnsrewrite rules are applied, a rewritten CNAME is checked and resolved by the next resolver instead of
+// the domain name. The rules allowing and rewriting the domain name and the rejections of the lists in monitor mode
+// are added to the result.
+func (f *Filter) Names(next Resolver) Resolver {
+	return ResolverFunc(func(ctx context.Context, name string) (*Result, error) {
+		filters := f.current()
+		var monitored []*RejectedError
+
+		rules, err := filters.checkName(name, &monitored)
+		if err != nil {
+			return nil, err
+		}
+
+		rw, err := filters.rewrite(name, &monitored)
+		if err != nil {
+			return nil, err
+		}
+
+		var result *Result
+		switch {
+		case rw == nil:
+			result, err = next.Resolve(ctx, name)
+		case rw.cname != "":
+			result, err = f.resolveCNAME(ctx, next, filters, name, rw.cname, &monitored)
+		default:
+			// The rewritten IPs may come from a remote deny list, they are checked like resolved IPs
+			if err = f.checkIPs(filters, name, rw.ips, &monitored); err == nil {
+				result = &Result{Name: name, IP: preferIPv4(rw.ips), IPs: rw.ips, Cache: CacheMiss}
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if rw != nil {
+			for _, rule := range rw.rules {
+				rules = append(rules, "dnsrewrite: "+rule)
+			}
+		}
+		if len(rules) == 0 && len(monitored) == 0 {
+			return result, nil
+		}
+
+		res := *result
+		res.Rules = append(rules, result.Rules...)
+		res.Monitored = append(monitored, result.Monitored...)
+		return &res, nil
+	})
+}
+
+// resolveCNAME resolves the CNAME given by a $dnsrewrite rule instead of the domain name.
+func (f *Filter) resolveCNAME(ctx context.Context, next Resolver, filters *filters, name, cname string, monitored *[]*RejectedError) (*Result, error) {
+	if _, err := filters.checkName(cname, monitored); err != nil {
+		var rejected *RejectedError
+		if errors.As(err, &rejected) {
+			return nil, &RejectedError{Kind: "cname", Rule: rejected.Rule, List: rejected.List, Target: name + "/" + cname}
+		}
+		return nil, err
+	}
+
+	result, err := next.Resolve(ctx, cname)
+	if err != nil {
+		return nil, err
+	}
+
+	res := *result
+	res.Name = name
+	res.CNAMEs = append([]string{cname}, result.CNAMEs...)
+	return &res, nil
+}
+
+// IPs returns the layer checking the canonical names (CNAME chain) and all the IPs resolved by the next resolver,
+// as the client may connect to any of them (e.g. DNS rebinding). The IPs of the record types rejected by the
+// $dnstype rules are removed. The rejections can be cached for the TTL of the resolution.
+func (f *Filter) IPs(next Resolver) Resolver {
+	return ResolverFunc(func(ctx context.Context, name string) (*Result, error) {
+		result, err := next.Resolve(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+
+		checked, err := f.checkResolution(f.current(), result)
+		if err != nil {
+			return nil, &cacheableError{error: err, ttl: result.TTL}
+		}
+		return checked, nil
+	})
+}
+
+// check checks an already resolved domain name like Names and IPs.
+// It returns the resolution with the rules allowing the domain name and the rejections of the lists in monitor mode.
+// A domain name rewritten by $dnsrewrite rules is rejected as its resolution may not match the rules anymore.
+func (f *Filter) check(result *Result) (*Result, error) {
+	filters := f.current()
+	var monitored []*RejectedError
+
+	rules, err := filters.checkName(result.Name, &monitored)
+	if err != nil {
+		return nil, err
+	}
+
+	rw, err := filters.rewrite(result.Name, &monitored)
+	if err != nil {
+		return nil, err
+	}
+	if rw != nil {
+		return nil, &RejectedError{Kind: "dnsrewrite", Rule: rw.rules[0], Target: result.Name}
+	}
+
+	checked, err := f.checkResolution(filters, result)
+	if err != nil {
+		return nil, err
+	}
+	if len(checked.IPs) != len(result.IPs) {
+		return nil, &RejectedError{Kind: "dnstype", Target: result.Name}
+	}
+
+	res := *checked
+	res.Rules = rules
+	res.Monitored = append(monitored, checked.Monitored...)
+	return &res, nil
+}
+
+// checkResolution checks the canonical names and the IPs of the resolution.
+// It returns the resolution without the IPs of the record types rejected by the $dnstype rules
+// and with the rejections of the lists in monitor mode.
+func (f *Filter) checkResolution(filters *filters, result *Result) (*Result, error) {
+	var monitored []*RejectedError
+
+	if err := filters.checkCNAMEs(result.Name, result.CNAMEs, &monitored); err != nil {
+		return nil, err
+	}
+
+	ips, err := filters.filterTypes(result.Name, result.IPs, &monitored)
+	if err != nil {
+		return nil, err
+	}
+	if err = f.checkIPs(filters, result.Name, ips, &monitored); err != nil {
+		return nil, err
+	}
+
+	if len(ips) == len(result.IPs) && len(monitored) == 0 {
+		return result, nil
+	}
+	res := *result
+	res.IP, res.IPs = preferIPv4(ips), ips
+	res.Monitored = append(monitored, result.Monitored...)
+	return &res, nil
+}
+
+func (f *Filter) checkIPs(filters *filters, name string, ips []net.IP, monitored *[]*RejectedError) error {
+	for _, ip := range ips {
+		if err := f.checkNetwork(name, ip); err != nil {
+			return err
+		}
+		if err := filters.checkIP(name, ip.String(), monitored); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *Filter) current() *filters {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.filters
+}
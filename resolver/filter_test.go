@@ -0,0 +1,139 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// A zoneUpstream answers with its records (in zone file format), following the CNAMEs like a recursive name server.
+type zoneUpstream []string
+
+func (z zoneUpstream) Exchange(_ context.Context, query *dns.Msg) (*dns.Msg, error) {
+	records := map[string][]dns.RR{}
+	for _, s := range z {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return nil, err
+		}
+		records[rr.Header().Name] = append(records[rr.Header().Name], rr)
+	}
+
+	answer := new(dns.Msg)
+	answer.SetReply(query)
+
+	q := query.Question[0]
+	if _, ok := records[q.Name]; !ok {
+		answer.Rcode = dns.RcodeNameError
+		return answer, nil
+	}
+
+	for name := q.Name; name != ""; {
+		rrs := records[name]
+		name = ""
+		for _, rr := range rrs {
+			switch rr := rr.(type) {
+			case *dns.CNAME:
+				answer.Answer = append(answer.Answer, rr)
+				name = rr.Target
+			default:
+				if rr.Header().Rrtype == q.Qtype {
+					answer.Answer = append(answer.Answer, rr)
+				}
+			}
+		}
+	}
+	return answer, nil
+}
+
+func (z zoneUpstream) String() string {
+	return "zone"
+}
+
+func TestFilterCNAME(t *testing.T) {
+	zone := zoneUpstream{
+		"clean.example.test. 300 IN A 192.0.2.20",
+		"alias.example.test. 300 IN CNAME clean.example.test.",
+		"www.example.test. 300 IN CNAME cdn.tracker.test.",
+		"cdn.tracker.test. 300 IN A 192.0.2.10",
+		"chain.example.test. 300 IN CNAME alias.example.test.",
+		"dual.example.test. 300 IN A 192.0.2.40",
+		"dual.example.test. 300 IN AAAA 2001:db8::40",
+		"allowed.tracker.test. 300 IN CNAME cdn.tracker.test.",
+	}
+
+	filter, err := NewFilter(Config{DenyList: []string{
+		"||tracker.test^",
+		"@@||allowed.tracker.test^",
+		"||rewritten.test^$dnsrewrite=alias.example.test",
+		"||blocked-rewrite.test^$dnsrewrite=cdn.tracker.test",
+		"||ip.test^$dnsrewrite=192.0.2.30",
+		"||dual.example.test^$dnstype=AAAA",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := Chain(NewUpstreamResolver(zone), Normalize, filter.Names, filter.IPs)
+
+	tests := []struct {
+		name   string
+		ips    []string
+		cnames []string
+		kind   string
+	}{
+		{name: "clean.example.test", ips: []string{"192.0.2.20"}},
+		{name: "alias.example.test", ips: []string{"192.0.2.20"}, cnames: []string{"clean.example.test"}},
+		{name: "chain.example.test", ips: []string{"192.0.2.20"}, cnames: []string{"alias.example.test", "clean.example.test"}},
+		{name: "www.example.test", kind: "cname"},
+		{name: "allowed.tracker.test", ips: []string{"192.0.2.10"}, cnames: []string{"cdn.tracker.test"}},
+		{name: "rewritten.test", ips: []string{"192.0.2.20"}, cnames: []string{"alias.example.test", "clean.example.test"}},
+		{name: "blocked-rewrite.test", kind: "cname"},
+		{name: "ip.test", ips: []string{"192.0.2.30"}},
+		{name: "dual.example.test", ips: []string{"192.0.2.40"}},
+		{name: "missing.example.test", kind: "-"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := r.Resolve(context.Background(), tt.name)
+			if tt.kind != "" {
+				var rejected *RejectedError
+				switch {
+				case err == nil:
+					t.Fatalf("resolved to %v, expected an error", result.IPs)
+				case tt.kind == "-":
+					if errors.As(err, &rejected) {
+						t.Errorf("rejected (%v), expected a resolution failure", err)
+					}
+				case !errors.As(err, &rejected) || rejected.Kind != tt.kind:
+					t.Errorf("error = %v, expected a %s rejection", err, tt.kind)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var ips []string
+			for _, ip := range result.IPs {
+				ips = append(ips, ip.String())
+			}
+			if !slices.Equal(ips, tt.ips) {
+				t.Errorf("ips = %v, expected %v", ips, tt.ips)
+			}
+			if !slices.Equal(result.CNAMEs, tt.cnames) {
+				t.Errorf("cnames = %v, expected %v", result.CNAMEs, tt.cnames)
+			}
+			if result.Name != tt.name {
+				t.Errorf("name = %s, expected %s", result.Name, tt.name)
+			}
+			if !result.IP.Equal(net.ParseIP(tt.ips[0])) {
+				t.Errorf("ip = %s, expected %s", result.IP, tt.ips[0])
+			}
+		})
+	}
+}
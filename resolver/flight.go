@@ -0,0 +1,71 @@
+package resolver
+
+import (
+	"context"
+	"sync"
+)
+
+// flights coalesces the concurrent resolutions of a name into a single one.
+// Unlike singleflight, the shared resolution is cancelled as soon as all its callers are gone.
+type flights struct {
+	mu    sync.Mutex
+	calls map[string]*flight
+}
+
+type flight struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	callers int
+	result  *Result
+	err     error
+}
+
+// do calls fn once for all the concurrent calls with the same name.
+func (g *flights) do(ctx context.Context, name string, fn func(context.Context, string) (*Result, error)) (*Result, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*flight{}
+	}
+
+	f, ok := g.calls[name]
+	if !ok {
+		fctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		g.calls[name] = f
+
+		go func() {
+			f.result, f.err = fn(fctx, name)
+			g.forget(name, f)
+			cancel()
+			close(f.done)
+		}()
+	}
+	f.callers++
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.result, f.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		f.callers--
+		if f.callers == 0 {
+			// Nobody waits the resolution anymore
+			f.cancel()
+			if g.calls[name] == f {
+				delete(g.calls, name)
+			}
+		}
+		g.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (g *flights) forget(name string, f *flight) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.calls[name] == f {
+		delete(g.calls, name)
+	}
+}
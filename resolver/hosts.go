@@ -0,0 +1,149 @@
+package resolver
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Hosts holds the static IPs of domain names.
+// A domain name starting with "*." matches all its subdomains (e.g. *.example.com matches a.b.example.com
+// but not example.com). An exact entry takes precedence over the wildcards and the longest wildcard wins.
+// The domain names are normalized (see NormalizeHost).
+// It is safe for concurrent use.
+type Hosts struct {
+	mu        sync.RWMutex
+	exact     map[string][]net.IP
+	wildcards map[string][]net.IP
+}
+
+// NewHosts returns the Hosts of the given domain names and IPs.
+func NewHosts(entries map[string][]string) (*Hosts, error) {
+	h := &Hosts{
+		exact:     map[string][]net.IP{},
+		wildcards: map[string][]net.IP{},
+	}
+
+	for host, ips := range entries {
+		if err := h.add(host, ips...); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// Add adds the given IPs to the host.
+func (h *Hosts) Add(host string, ips ...string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.add(host, ips...)
+}
+
+// Replace replaces all the entries by the given ones.
+func (h *Hosts) Replace(other *Hosts) {
+	other.mu.RLock()
+	exact, wildcards := other.exact, other.wildcards
+	other.mu.RUnlock()
+
+	h.mu.Lock()
+	h.exact, h.wildcards = exact, wildcards
+	h.mu.Unlock()
+}
+
+// Lookup returns the IPs of the given host.
+func (h *Hosts) Lookup(host string) ([]net.IP, bool) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if ips, ok := h.exact[host]; ok {
+		return ips, true
+	}
+
+	for domain := host; ; {
+		_, parent, ok := strings.Cut(domain, ".")
+		if !ok {
+			return nil, false
+		}
+		if ips, ok := h.wildcards[parent]; ok {
+			return ips, true
+		}
+		domain = parent
+	}
+}
+
+func (h *Hosts) add(host string, ips ...string) error {
+	if len(ips) == 0 {
+		return errors.Errorf("no ip for host %q", host)
+	}
+
+	entries := h.exact
+	name := host
+	if domain, ok := strings.CutPrefix(host, "*."); ok {
+		entries, name = h.wildcards, domain
+	}
+	name, err := NormalizeHost(name)
+	if err != nil || strings.Contains(name, "*") {
+		return errors.Errorf("invalid host %q", host)
+	}
+	host = name
+
+	for _, ip := range ips {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return errors.Errorf("failed to parse ip: %q", ip)
+		}
+		entries[host] = append(entries[host], parsed)
+	}
+	return nil
+}
+
+// ParseHostsFile parses the entries of a file using the /etc/hosts format.
+func ParseHostsFile(payload []byte) (map[string][]string, error) {
+	entries := map[string][]string{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(payload))
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, errors.Errorf("line %d: no host for %s", n, fields[0])
+		}
+
+		ip := fields[0]
+		if i := strings.IndexByte(ip, '%'); i > 0 {
+			ip = ip[:i] // Zone of link-local addresses
+		}
+		if net.ParseIP(ip) == nil {
+			return nil, errors.Errorf("line %d: failed to parse ip: %q", n, fields[0])
+		}
+
+		for _, host := range fields[1:] {
+			entries[host] = append(entries[host], ip)
+		}
+	}
+
+	return entries, scanner.Err()
+}
+
+// LoadHostsFile reads the entries of a file using the /etc/hosts format.
+func LoadHostsFile(filename string) (map[string][]string, error) {
+	payload, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read hosts file")
+	}
+
+	entries, err := ParseHostsFile(payload)
+	return entries, errors.Wrap(err, filename)
+}
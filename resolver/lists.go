@@ -0,0 +1,247 @@
+package resolver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/urlfilter/rules"
+	"github.com/pkg/errors"
+)
+
+// FirstListID is the filter list ID of the first list loaded by a ListLoader.
+// The following lists get the next IDs in the order of the sources.
+const FirstListID = 100
+
+// MaxListSize is the maximum size of a remote list.
+const MaxListSize = 64 << 20
+
+// A List is a deny list loaded from a file or an HTTP(S) URL.
+type List struct {
+	ID    rules.ListID
+	Name  string
+	Rules []byte
+	// Source is the configured file, directory or URL the list has been loaded from.
+	Source string
+	// Monitor enables the monitor mode of the list: its rejections are reported but the hosts are allowed.
+	Monitor bool
+}
+
+// A ListLoader loads deny lists from local files, directories and HTTP(S) URLs.
+// The remote lists are fetched with conditional requests and kept in a cache
+// directory used as a fallback when they cannot be fetched.
+type ListLoader struct {
+	sources []string
+	cache   string
+	client  *http.Client
+
+	mu     sync.Mutex
+	remote map[string]*remoteList
+}
+
+type remoteList struct {
+	ETag         string `json:"etag"`
+	LastModified string `json:"last_modified"`
+	rules        []byte
+}
+
+// NewListLoader returns a new ListLoader for the given sources.
+// An empty cache directory disables the on-disk fallback.
+func NewListLoader(sources []string, cache string) *ListLoader {
+	return &ListLoader{
+		sources: sources,
+		cache:   cache,
+		client:  &http.Client{Timeout: time.Minute},
+		remote:  map[string]*remoteList{},
+	}
+}
+
+// Load loads all the lists of the sources.
+// A list that cannot be loaded fails the whole loading.
+func (l *ListLoader) Load(ctx context.Context) ([]List, error) {
+	var names []string
+	sources := map[string]string{} // By name
+	for _, source := range l.sources {
+		if isURL(source) {
+			names = append(names, source)
+			sources[source] = source
+			continue
+		}
+
+		info, err := os.Stat(source)
+		if err != nil {
+			return nil, errors.Wrap(err, "list")
+		}
+		if !info.IsDir() {
+			names = append(names, source)
+			sources[source] = source
+			continue
+		}
+
+		entries, err := os.ReadDir(source)
+		if err != nil {
+			return nil, errors.Wrap(err, "list")
+		}
+
+		var files []string
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			files = append(files, filepath.Join(source, entry.Name()))
+			sources[files[len(files)-1]] = source
+		}
+		sort.Strings(files)
+		names = append(names, files...)
+	}
+
+	lists := make([]List, 0, len(names))
+	for i, name := range names {
+		var payload []byte
+		var err error
+		if isURL(name) {
+			payload, err = l.fetch(ctx, name)
+		} else {
+			payload, err = os.ReadFile(name)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "list %s", name)
+		}
+
+		lists = append(lists, List{
+			ID:     rules.ListID(FirstListID + i),
+			Name:   name,
+			Rules:  payload,
+			Source: sources[name],
+		})
+	}
+
+	return lists, nil
+}
+
+func (l *ListLoader) fetch(ctx context.Context, url string) ([]byte, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	previous, ok := l.remote[url]
+	if !ok {
+		previous = l.read(url)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if previous != nil {
+		if previous.ETag != "" {
+			req.Header.Set("If-None-Match", previous.ETag)
+		}
+		if previous.LastModified != "" {
+			req.Header.Set("If-Modified-Since", previous.LastModified)
+		}
+	}
+
+	current, err := l.download(req, previous)
+	if err != nil {
+		if previous != nil {
+			// Fallback on the last known version
+			l.remote[url] = previous
+			return previous.rules, nil
+		}
+		return nil, err
+	}
+
+	l.remote[url] = current
+	if current != previous {
+		l.write(url, current)
+	}
+	return current.rules, nil
+}
+
+func (l *ListLoader) download(req *http.Request, previous *remoteList) (*remoteList, error) {
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && previous != nil:
+		return previous, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, errors.Errorf("unexpected status %s", resp.Status)
+	}
+
+	payload, err := io.ReadAll(io.LimitReader(resp.Body, MaxListSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) > MaxListSize {
+		return nil, errors.Errorf("list larger than %d bytes", MaxListSize)
+	}
+
+	return &remoteList{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		rules:        payload,
+	}, nil
+}
+
+// read reads the cached version of the remote list.
+func (l *ListLoader) read(url string) *remoteList {
+	if l.cache == "" {
+		return nil
+	}
+
+	filename := l.filename(url)
+	payload, err := os.ReadFile(filename)
+	if err != nil {
+		return nil
+	}
+
+	list := &remoteList{rules: payload}
+	if meta, err := os.ReadFile(filename + ".json"); err == nil {
+		json.Unmarshal(meta, list)
+	}
+	return list
+}
+
+// write writes the remote list to the cache, errors are ignored as the cache is only a fallback.
+func (l *ListLoader) write(url string, list *remoteList) {
+	if l.cache == "" {
+		return
+	}
+
+	if err := os.MkdirAll(l.cache, 0755); err != nil {
+		return
+	}
+
+	filename := l.filename(url)
+	if err := os.WriteFile(filename, list.rules, 0644); err != nil {
+		return
+	}
+
+	meta, err := json.Marshal(list)
+	if err != nil {
+		return
+	}
+	os.WriteFile(filename+".json", meta, 0644)
+}
+
+func (l *ListLoader) filename(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(l.cache, hex.EncodeToString(sum[:8])+".txt")
+}
+
+func isURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
@@ -0,0 +1,209 @@
+package resolver
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/AdguardTeam/urlfilter/rules"
+)
+
+// A listServer serves its rules with an ETag, or fails with its status.
+type listServer struct {
+	mu       sync.Mutex
+	rules    string
+	etag     string
+	status   int
+	size     int64
+	requests []string // If-None-Match of the requests
+}
+
+func (s *listServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests = append(s.requests, r.Header.Get("If-None-Match"))
+	switch {
+	case s.status != 0:
+		w.WriteHeader(s.status)
+	case s.size > 0:
+		io.CopyN(w, zeros{}, s.size)
+	case r.Header.Get("If-None-Match") == s.etag:
+		w.WriteHeader(http.StatusNotModified)
+	default:
+		w.Header().Set("ETag", s.etag)
+		io.WriteString(w, s.rules)
+	}
+}
+
+func (s *listServer) set(f func(s *listServer)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f(s)
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestListLoaderRemote(t *testing.T) {
+	server := &listServer{rules: "||v1.test^\n", etag: `"v1"`}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	cache := t.TempDir()
+	url := ts.URL + "/list.txt"
+
+	tests := []struct {
+		name    string
+		update  func(s *listServer)
+		cache   string
+		rules   string
+		err     string
+		request string // If-None-Match sent to the server
+	}{
+		{name: "download", cache: cache, rules: "||v1.test^\n"},
+		{name: "not modified", cache: cache, rules: "||v1.test^\n", request: `"v1"`},
+		{
+			name:    "modified",
+			update:  func(s *listServer) { s.rules, s.etag = "||v2.test^\n", `"v2"` },
+			cache:   cache,
+			rules:   "||v2.test^\n",
+			request: `"v1"`,
+		},
+		{
+			name:    "cache fallback",
+			update:  func(s *listServer) { s.status = http.StatusInternalServerError },
+			cache:   cache,
+			rules:   "||v2.test^\n",
+			request: `"v2"`,
+		},
+		{name: "no cache", err: "unexpected status 500"},
+		{
+			name:   "too large",
+			update: func(s *listServer) { s.status, s.size = 0, MaxListSize+1 },
+			err:    "list larger than",
+		},
+		{
+			name:    "too large with cache",
+			cache:   cache,
+			rules:   "||v2.test^\n",
+			request: `"v2"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.update != nil {
+				server.set(tt.update)
+			}
+			server.set(func(s *listServer) { s.requests = nil })
+
+			// A new loader reads the ETag of the cached list
+			lists, err := NewListLoader([]string{url}, tt.cache).Load(context.Background())
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error = %v, expected %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(lists) != 1 {
+				t.Fatalf("%d lists, expected 1", len(lists))
+			}
+			if got := string(lists[0].Rules); got != tt.rules {
+				t.Errorf("rules = %q, expected %q", got, tt.rules)
+			}
+			if lists[0].ID != FirstListID || lists[0].Name != url || lists[0].Source != url {
+				t.Errorf("list = %d %s %s, expected %d %s", lists[0].ID, lists[0].Name, lists[0].Source, FirstListID, url)
+			}
+			if len(server.requests) != 1 || server.requests[0] != tt.request {
+				t.Errorf("requests = %q, expected If-None-Match %q", server.requests, tt.request)
+			}
+		})
+	}
+}
+
+func TestListLoaderFiles(t *testing.T) {
+	dir := t.TempDir()
+	lists := filepath.Join(dir, "lists")
+	files := map[string]string{
+		"lists/b.txt":   "||b.test^",
+		"lists/a.txt":   "||a.test^",
+		"lists/.hidden": "||hidden.test^",
+		"single.txt":    "||single.test^",
+	}
+	if err := os.Mkdir(lists, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(lists, "nested"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		sources []string
+		lists   []List
+		err     bool
+	}{
+		{
+			name:    "file",
+			sources: []string{filepath.Join(dir, "single.txt")},
+			lists:   []List{{Name: filepath.Join(dir, "single.txt"), Rules: []byte("||single.test^"), Source: filepath.Join(dir, "single.txt")}},
+		},
+		{
+			name:    "directory",
+			sources: []string{lists, filepath.Join(dir, "single.txt")},
+			lists: []List{
+				{Name: filepath.Join(lists, "a.txt"), Rules: []byte("||a.test^"), Source: lists},
+				{Name: filepath.Join(lists, "b.txt"), Rules: []byte("||b.test^"), Source: lists},
+				{Name: filepath.Join(dir, "single.txt"), Rules: []byte("||single.test^"), Source: filepath.Join(dir, "single.txt")},
+			},
+		},
+		{name: "missing", sources: []string{filepath.Join(dir, "missing.txt")}, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewListLoader(tt.sources, "").Load(context.Background())
+			if tt.err {
+				if err == nil {
+					t.Fatal("error expected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(got) != len(tt.lists) {
+				t.Fatalf("%d lists, expected %d", len(got), len(tt.lists))
+			}
+			for i, list := range got {
+				expected := tt.lists[i]
+				expected.ID = FirstListID + rules.ListID(i)
+				if list.ID != expected.ID || list.Name != expected.Name || list.Source != expected.Source || string(list.Rules) != string(expected.Rules) {
+					t.Errorf("list %d = %+v, expected %+v", i, list, expected)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type (
+	// A Resolver resolves the domain names.
+	// It returns an error when the domain name must not be proxified.
+	Resolver interface {
+		Resolve(ctx context.Context, name string) (*Result, error)
+	}
+
+	// ResolverFunc is an adapter to use an ordinary function as a Resolver.
+	ResolverFunc func(ctx context.Context, name string) (*Result, error)
+
+	// A Middleware is a layer of a resolution chain wrapping the next Resolver.
+	Middleware func(next Resolver) Resolver
+)
+
+// Resolve calls f(ctx, name).
+func (f ResolverFunc) Resolve(ctx context.Context, name string) (*Result, error) {
+	return f(ctx, name)
+}
+
+// Chain returns the resolver wrapped by the given middlewares, the first middleware being the outermost layer.
+// e.g. Chain(upstream, Normalize, cache.Middleware, filter.Names, hosts.Middleware, filter.IPs)
+func Chain(resolver Resolver, middlewares ...Middleware) Resolver {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		resolver = middlewares[i](resolver)
+	}
+	return resolver
+}
+
+// A cacheableError is an error of the resolution that can be cached during the given TTL.
+type cacheableError struct {
+	error
+	ttl time.Duration
+}
+
+func (e *cacheableError) Unwrap() error {
+	return e.error
+}
+
+// NewUpstreamResolver returns the Resolver querying the A and AAAA records of the domain names to the given upstream.
+func NewUpstreamResolver(upstream Upstream) Resolver {
+	return ResolverFunc(func(ctx context.Context, name string) (*Result, error) {
+		if ip := net.ParseIP(name); ip != nil {
+			return literal(name, ip), nil
+		}
+
+		ips, cnames, ttl, err := lookupIP(ctx, upstream, name)
+		return lookupResult(name, ips, cnames, ttl, err)
+	})
+}
+
+// NewHostResolver returns the Resolver using the host resolver (e.g. /etc/hosts and /etc/resolv.conf).
+// As the host resolver does not expose the DNS TTLs and the CNAME chains, the resolutions get HostResolverTTL
+// and no canonical names.
+func NewHostResolver() Resolver {
+	resolver := new(net.Resolver)
+
+	return ResolverFunc(func(ctx context.Context, name string) (*Result, error) {
+		if ip := net.ParseIP(name); ip != nil {
+			return literal(name, ip), nil
+		}
+
+		addrs, err := resolver.LookupIPAddr(ctx, name)
+		ips := make([]net.IP, 0, len(addrs))
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+		return lookupResult(name, ips, nil, HostResolverTTL, err)
+	})
+}
+
+// literal returns the result of an IP literal, cached as long as possible.
+func literal(name string, ip net.IP) *Result {
+	return &Result{Name: name, IP: ip, IPs: []net.IP{ip}, TTL: CacheTTL, Cache: CacheMiss}
+}
+
+func lookupResult(name string, ips []net.IP, cnames []string, ttl time.Duration, err error) (*Result, error) {
+	if err != nil {
+		err = errors.Wrapf(err, "[resolve] %s", name)
+		if dnserr := new(net.DNSError); errors.As(err, &dnserr) && dnserr.IsNotFound {
+			return nil, &cacheableError{error: err, ttl: ttl}
+		}
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, &cacheableError{error: errors.Errorf("[resolve] no IP for %s", name), ttl: ttl}
+	}
+
+	return &Result{Name: name, IP: preferIPv4(ips), IPs: ips, CNAMEs: cnames, TTL: ttl, Cache: CacheMiss}, nil
+}
+
+// Middleware returns the layer resolving the hosts without calling the next resolver.
+func (h *Hosts) Middleware(next Resolver) Resolver {
+	return ResolverFunc(func(ctx context.Context, name string) (*Result, error) {
+		if ips, ok := h.Lookup(name); ok {
+			return &Result{Name: name, IP: preferIPv4(ips), IPs: ips, Cache: CacheMiss}, nil
+		}
+		return next.Resolve(ctx, name)
+	})
+}
@@ -0,0 +1,146 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// PrivateNetworks is the list of the networks blocked by Config.BlockPrivate:
+// unspecified, loopback, private, shared (CGNAT), link-local (including the cloud metadata services),
+// benchmarking, multicast and reserved addresses.
+var PrivateNetworks = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b:1::/48",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// Prefixes of the IPv6 addresses embedding an IPv4.
+var (
+	nat64     = netip.MustParsePrefix("64:ff9b::/96")
+	sixToFour = netip.MustParsePrefix("2002::/16")
+)
+
+type networks []netip.Prefix
+
+func parseNetworks(cidrs []string) (networks, error) {
+	n := make(networks, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid network %q", cidr)
+		}
+		n = append(n, prefix.Masked())
+	}
+	return n, nil
+}
+
+// match returns the network containing the given IP.
+// The IPv4 embedded in IPv4-mapped, NAT64 and 6to4 addresses are also checked.
+func (n networks) match(ip net.IP) (netip.Prefix, bool) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+
+	candidates := []netip.Addr{addr.Unmap()}
+	if addr.Is6() && !addr.Is4In6() {
+		b := addr.As16()
+		switch {
+		case nat64.Contains(addr):
+			candidates = append(candidates, netip.AddrFrom4([4]byte(b[12:16])))
+		case sixToFour.Contains(addr):
+			candidates = append(candidates, netip.AddrFrom4([4]byte(b[2:6])))
+		}
+	}
+
+	for _, candidate := range candidates {
+		for _, prefix := range n {
+			if prefix.Contains(candidate) {
+				return prefix, true
+			}
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// checkNetwork checks the resolved IP of the domain name against the blocked networks.
+func (f *Filter) checkNetwork(name string, ip net.IP) error {
+	if prefix, ok := f.blocked.match(ip); ok {
+		return &RejectedError{Kind: "network", Rule: prefix.String(), Target: name + "/" + ip.String()}
+	}
+	return nil
+}
+
+type hostKey struct{}
+
+// WithHost returns a copy of ctx holding the domain name whose connection is dialed or filtered.
+// DialControlContext and FilterIP allow the IPs of the hosts only for the domain names mapping to them.
+func WithHost(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, hostKey{}, name)
+}
+
+// DialControl verifies the address of the socket about to be connected against the blocked networks.
+// It is meant to be used as net.Dialer.Control so the connections cannot reach a blocked network,
+// whatever the way their address has been resolved (e.g. DNS rebinding).
+// Without the dialed domain name, the IPs of the hosts are not allowed (see DialControlContext).
+func (r *NameResolver) DialControl(network, address string, c syscall.RawConn) error {
+	return r.DialControlContext(context.Background(), network, address, c)
+}
+
+// DialControlContext is the DialControl meant to be used as net.Dialer.ControlContext.
+// The IPs of the hosts are allowed when they are the ones of the domain name of the context (see WithHost).
+func (r *NameResolver) DialControlContext(ctx context.Context, _, address string, _ syscall.RawConn) error {
+	if len(r.filter.blocked) == 0 {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || r.isHostIP(ctx, ip) {
+		return nil
+	}
+
+	if prefix, ok := r.filter.blocked.match(ip); ok {
+		return &RejectedError{Kind: "dial", Rule: prefix.String(), Target: ip.String()}
+	}
+	return nil
+}
+
+// isHostIP returns true when the IP is one of the IPs of the hosts of the domain name of the context (see WithHost).
+func (r *NameResolver) isHostIP(ctx context.Context, ip net.IP) bool {
+	name, _ := ctx.Value(hostKey{}).(string)
+	if name == "" {
+		return false
+	}
+
+	name, err := NormalizeHost(name)
+	if err != nil {
+		return false
+	}
+
+	ips, ok := r.hosts.Lookup(name)
+	return ok && slices.ContainsFunc(ips, ip.Equal)
+}
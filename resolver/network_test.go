@@ -0,0 +1,124 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestNetworksMatch(t *testing.T) {
+	blocked, err := parseNetworks(PrivateNetworks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip       string
+		expected string // Matching network, empty when allowed
+	}{
+		{"10.1.2.3", "10.0.0.0/8"},
+		{"169.254.169.254", "169.254.0.0/16"},
+		{"8.8.8.8", ""},
+		// IPv4-mapped
+		{"::ffff:10.1.2.3", "10.0.0.0/8"},
+		{"::ffff:127.0.0.1", "127.0.0.0/8"},
+		{"::ffff:a9fe:a9fe", "169.254.0.0/16"},
+		{"::ffff:8.8.8.8", ""},
+		// NAT64
+		{"64:ff9b::10.1.2.3", "10.0.0.0/8"},
+		{"64:ff9b::7f00:1", "127.0.0.0/8"},
+		{"64:ff9b::a9fe:a9fe", "169.254.0.0/16"},
+		{"64:ff9b::8.8.8.8", ""},
+		{"64:ff9b:1::1", "64:ff9b:1::/48"},
+		// 6to4
+		{"2002:a01:203::1", "10.0.0.0/8"},
+		{"2002:7f00:1::", "127.0.0.0/8"},
+		{"2002:a9fe:a9fe:1::1", "169.254.0.0/16"},
+		{"2002:808:808::1", ""},
+		// IPv6
+		{"::1", "::1/128"},
+		{"::", "::/128"},
+		{"fe80::1", "fe80::/10"},
+		{"fd00::1", "fc00::/7"},
+		{"2001:4860:4860::8888", ""},
+	}
+
+	for _, test := range tests {
+		prefix, ok := blocked.match(net.ParseIP(test.ip))
+		actual := ""
+		if ok {
+			actual = prefix.String()
+		}
+		if actual != test.expected {
+			t.Errorf("match(%s) = %q, expected %q", test.ip, actual, test.expected)
+		}
+	}
+}
+
+func TestHostsExemption(t *testing.T) {
+	r, err := New(Config{BlockPrivate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.SetHosts(map[string][]string{
+		"internal.test":   {"10.0.0.5"},
+		"*.internal.test": {"10.0.0.6"},
+		"other.test":      {"192.0.2.1"},
+		"localhost.test":  {"::1"},
+		"unrelated.test":  {"10.0.0.7"},
+		"another-ip.test": {"10.0.0.5", "10.0.0.8"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host    string // Host of the context, none when empty
+		ip      string
+		allowed bool
+	}{
+		{"internal.test", "10.0.0.5", true},
+		{"INTERNAL.test.", "10.0.0.5", true},
+		{"a.internal.test", "10.0.0.6", true},
+		{"localhost.test", "::1", true},
+		{"another-ip.test", "10.0.0.5", true},
+		{"internal.test", "10.0.0.7", false},   // IP of another host
+		{"a.internal.test", "10.0.0.5", false}, // IP of the parent host
+		{"other.test", "10.0.0.5", false},
+		{"public.test", "10.0.0.5", false},
+		{"", "10.0.0.5", false}, // IP literal
+		{"10.0.0.5", "10.0.0.5", false},
+		{"", "192.0.2.1", true},
+	}
+
+	for _, test := range tests {
+		ctx := context.Background()
+		if test.host != "" {
+			ctx = WithHost(ctx, test.host)
+		}
+
+		err := r.DialControlContext(ctx, "tcp", net.JoinHostPort(test.ip, "443"), nil)
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("DialControlContext(%q, %s) = %v, expected allowed: %v", test.host, test.ip, err, test.allowed)
+		}
+
+		err = r.FilterIP(ctx, net.ParseIP(test.ip))
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("FilterIP(%q, %s) = %v, expected allowed: %v", test.host, test.ip, err, test.allowed)
+		}
+	}
+
+	// Without domain name, the IPs of the hosts are not allowed
+	if err := r.DialControl("tcp", "10.0.0.5:443", nil); !errors.Is(err, ErrHostRejected) {
+		t.Errorf("DialControl(10.0.0.5) = %v, expected a rejection", err)
+	}
+
+	// The resolutions apply the same rule
+	if _, err := r.Resolve(context.Background(), "internal.test"); err != nil {
+		t.Errorf("Resolve(internal.test) = %v, expected the IP of the host", err)
+	}
+	if _, err := r.Resolve(context.Background(), "10.0.0.5"); !errors.Is(err, ErrHostRejected) {
+		t.Errorf("Resolve(10.0.0.5) = %v, expected a rejection", err)
+	}
+}
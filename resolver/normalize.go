@@ -0,0 +1,194 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/idna"
+)
+
+// profile converts the internationalized domain names to punycode.
+// The underscores are allowed as they are commonly used in hostnames.
+var profile = idna.New(idna.MapForLookup(), idna.StrictDomainName(false), idna.BidiRule())
+
+// NormalizeHost returns the canonical form of the given host checked against the rules:
+//   - lowercase without trailing dot (e.g. EXAMPLE.com. is example.com)
+//   - internationalized domain names in punycode (e.g. bücher.example is xn--bcher-kva.example)
+//   - IPv6 without brackets in their canonical form (e.g. [0:0::1] is ::1), the IPv4-mapped ones as IPv4
+//   - IPv4 in dotted decimal whatever their inet_aton(3) form (e.g. 2130706433, 0x7f.1 or 0177.0.0.1 is 127.0.0.1)
+func NormalizeHost(host string) (string, error) {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		ip := net.ParseIP(host[1 : len(host)-1])
+		if ip == nil {
+			return "", errors.Errorf("invalid IPv6 host %q", host)
+		}
+		return ip.String(), nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String(), nil
+	}
+
+	name := strings.TrimRight(host, ".")
+	if name == "" {
+		return "", errors.Errorf("invalid host %q", host)
+	}
+
+	if !isASCII(name) {
+		var err error
+		name, err = profile.ToASCII(name)
+		if err != nil {
+			return "", errors.Wrapf(err, "invalid host %q", host)
+		}
+	}
+	name = strings.ToLower(name)
+
+	// As for URLs, a host ending with a number is an IPv4 (e.g. 127.1), never a domain name.
+	labels := strings.Split(name, ".")
+	if isNumber(labels[len(labels)-1]) {
+		ip, ok := parseInetAton(labels)
+		if !ok {
+			return "", errors.Errorf("invalid IPv4 host %q", host)
+		}
+		return ip.String(), nil
+	}
+
+	if strings.ContainsAny(name, " \t/\\@:%?#[]") || strings.Contains(name, "..") {
+		return "", errors.Errorf("invalid host %q", host)
+	}
+	return name, nil
+}
+
+// Normalize is the layer normalizing the domain names with NormalizeHost before calling the next resolver.
+func Normalize(next Resolver) Resolver {
+	return ResolverFunc(func(ctx context.Context, name string) (*Result, error) {
+		host, err := NormalizeHost(name)
+		if err != nil {
+			return nil, err
+		}
+		return next.Resolve(ctx, host)
+	})
+}
+
+// defaultPorts are the ports omitted from the normalized URLs of their scheme.
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// normalizeURL returns the URL with its host normalized, its default port removed and the unreserved characters
+// of its path decoded (e.g. http://EXAMPLE.com:80/%61ds/ is http://example.com/ads/),
+// or the URL as is when it cannot be normalized.
+func normalizeURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+
+	host, err := NormalizeHost(u.Hostname())
+	if err != nil {
+		return rawURL
+	}
+
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port := u.Port(); port != "" && port != defaultPorts[u.Scheme] {
+		host += ":" + port
+	}
+	u.Host = host
+	u.RawPath = unescapeUnreserved(u.EscapedPath()) // Kept by String as it is a valid encoding of the path
+	return u.String()
+}
+
+// unescapeUnreserved decodes the percent-encoded unreserved characters (RFC 3986 section 2.3) of an escaped path,
+// the other encoded characters are kept as is (e.g. /%61ds%2F is /ads%2F).
+func unescapeUnreserved(path string) string {
+	if !strings.Contains(path, "%") {
+		return path
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '%' && i+2 < len(path) {
+			c, err := strconv.ParseUint(path[i+1:i+3], 16, 8)
+			if err == nil && isUnreserved(byte(c)) {
+				b.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-._~", c) >= 0
+}
+
+// parseInetAton parses the labels of an IPv4 written in one of the forms accepted by inet_aton(3):
+// 1 to 4 decimal, octal (0 prefix) or hexadecimal (0x prefix) numbers, the last one filling the remaining bytes.
+func parseInetAton(labels []string) (net.IP, bool) {
+	if len(labels) > 4 {
+		return nil, false
+	}
+
+	var parts []uint64
+	for _, label := range labels {
+		base := 10
+		switch {
+		case strings.HasPrefix(label, "0x"):
+			base, label = 16, label[2:]
+			if label == "" {
+				label = "0"
+			}
+		case len(label) > 1 && label[0] == '0':
+			base, label = 8, label[1:]
+		}
+
+		n, err := strconv.ParseUint(label, base, 32)
+		if err != nil {
+			return nil, false
+		}
+		parts = append(parts, n)
+	}
+
+	last := parts[len(parts)-1]
+	if last >= 1<<(8*(5-len(parts))) {
+		return nil, false
+	}
+
+	ip := uint32(last)
+	for i, n := range parts[:len(parts)-1] {
+		if n > 0xff {
+			return nil, false
+		}
+		ip |= uint32(n) << (8 * (3 - i))
+	}
+	return net.IPv4(byte(ip>>24), byte(ip>>16), byte(ip>>8), byte(ip)), true
+}
+
+// isNumber returns true when the label is a decimal or hexadecimal (0x prefix) number.
+func isNumber(label string) bool {
+	if hex, ok := strings.CutPrefix(label, "0x"); ok {
+		label = hex
+		if label == "" {
+			return true
+		}
+		return strings.Trim(label, "0123456789abcdef") == ""
+	}
+	return label != "" && strings.Trim(label, "0123456789") == ""
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+package resolver
+
+import "testing"
+
+func TestNormalizeHost(t *testing.T) {
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		// Case and trailing dot
+		{"example.com", "example.com"},
+		{"EXAMPLE.Com", "example.com"},
+		{"example.com.", "example.com"},
+		{"EXAMPLE.COM..", "example.com"},
+		{"_dmarc.example.com", "_dmarc.example.com"},
+		// IDNA
+		{"bücher.example", "xn--bcher-kva.example"},
+		{"BÜCHER.example.", "xn--bcher-kva.example"},
+		{"xn--bcher-kva.example", "xn--bcher-kva.example"},
+		{"例え.テスト", "xn--r8jz45g.xn--zckzah"},
+		{"ｅｘａｍｐｌｅ.com", "example.com"},
+		// IPv4 in dotted decimal
+		{"127.0.0.1", "127.0.0.1"},
+		{"127.0.0.1.", "127.0.0.1"},
+		// Octal
+		{"0177.0.0.1", "127.0.0.1"},
+		{"0177.0000.0000.0001", "127.0.0.1"},
+		{"010.010.010.010", "8.8.8.8"},
+		// Hexadecimal
+		{"0x7f.0.0.1", "127.0.0.1"},
+		{"0X7F.0.0.1", "127.0.0.1"},
+		{"0x7f000001", "127.0.0.1"},
+		{"0xa9.0xfe.0xa9.0xfe", "169.254.169.254"},
+		{"0x.0.0.0", "0.0.0.0"},
+		// Short forms
+		{"2130706433", "127.0.0.1"},
+		{"127.1", "127.0.0.1"},
+		{"127.0.1", "127.0.0.1"},
+		{"10.65535", "10.0.255.255"},
+		{"169.254.43518", "169.254.169.254"},
+		{"0", "0.0.0.0"},
+		{"4294967295", "255.255.255.255"},
+		// IPv6
+		{"[::1]", "::1"},
+		{"[0:0::1]", "::1"},
+		{"0:0:0:0:0:0:0:1", "::1"},
+		{"[::ffff:127.0.0.1]", "127.0.0.1"},
+		{"::FFFF:7f00:1", "127.0.0.1"},
+		{"[2001:DB8::1]", "2001:db8::1"},
+	}
+
+	for _, test := range tests {
+		actual, err := NormalizeHost(test.host)
+		if err != nil {
+			t.Errorf("NormalizeHost(%q) = %v, expected %q", test.host, err, test.expected)
+			continue
+		}
+		if actual != test.expected {
+			t.Errorf("NormalizeHost(%q) = %q, expected %q", test.host, actual, test.expected)
+		}
+	}
+}
+
+func TestNormalizeHostErrors(t *testing.T) {
+	for _, host := range []string{
+		"",
+		".",
+		"[example.com]",
+		"[::1",
+		"4294967296",  // Overflows an IPv4
+		"256.0.0.1",   // Part overflowing a byte
+		"1.2.3.256",   // Last part overflowing a byte
+		"1.2.65536",   // Last part overflowing 2 bytes
+		"1.2.3.4.5",   // Too many parts
+		"0x100.0.0.1", // Hexadecimal part overflowing a byte
+		"08.0.0.1",    // Invalid octal
+		"0xg.0.0.1",   // Invalid hexadecimal
+		"example.com/path",
+		"user@example.com",
+		"example..com",
+		"example com",
+		"example.com:443",
+		"1.2.3.example.4", // Ends with a number, not an IPv4
+	} {
+		if actual, err := NormalizeHost(host); err == nil {
+			t.Errorf("NormalizeHost(%q) = %q, expected an error", host, actual)
+		}
+	}
+}
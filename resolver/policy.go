@@ -0,0 +1,209 @@
+package resolver
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/AdguardTeam/urlfilter"
+	"github.com/AdguardTeam/urlfilter/rules"
+	"github.com/miekg/dns"
+)
+
+// Policies.
+const (
+	// PolicyDenyList allows all the hosts except the ones matching the deny list.
+	PolicyDenyList = "denylist"
+	// PolicyAllowList rejects all the hosts except the ones matching the allow list
+	// and not rejected by the deny list.
+	PolicyAllowList = "allowlist"
+)
+
+// A RejectedError is returned when a host is rejected by the policy.
+// It matches ErrHostRejected with errors.Is.
+type RejectedError struct {
+	// Kind is the kind of the check that rejected the host (e.g. domain, domain/ip, url, policy).
+	// It is prefixed by "monitor " when the list of the rule is in monitor mode and the host is not rejected.
+	Kind string
+	// Rule is the matching rule, empty when no rule matches (e.g. default deny of the allowlist policy).
+	Rule string
+	// Target is the rejected host, IP or URL.
+	Target string
+	// List is the name of the list of the rule (e.g. "denylist" or the file or URL of a loaded list).
+	List string
+}
+
+func (e *RejectedError) Error() string {
+	if e.Rule == "" {
+		return fmt.Sprintf("[%s] %s: %s", e.Kind, e.Target, ErrHostRejected)
+	}
+	return fmt.Sprintf("[%s][%s] %s: %s", e.Kind, e.Rule, e.Target, ErrHostRejected)
+}
+
+// Is returns true for ErrHostRejected.
+func (e *RejectedError) Is(target error) bool {
+	return target == ErrHostRejected
+}
+
+// checkName checks the domain name against the policy and returns the rules allowing it.
+// The rejections of the lists in monitor mode are added to monitored.
+func (f *filters) checkName(name string, monitored *[]*RejectedError) ([]string, error) {
+	m, matched := match(f.rejects, name)
+	if matched && !m.exception {
+		if err := f.reject(m, "domain", name, monitored); err != nil {
+			return nil, err
+		}
+	}
+
+	var rules []string
+	if m.exception {
+		rules = append(rules, "denylist: "+m.rule)
+	}
+
+	// An exception (@@) of the deny list also allows the host with the allowlist policy.
+	if f.policy != PolicyAllowList || m.exception {
+		return rules, nil
+	}
+
+	m, matched = match(f.allows, name)
+	if !matched || m.exception {
+		return nil, &RejectedError{Kind: "policy", Rule: m.rule, Target: name}
+	}
+	return []string{"allowlist: " + m.rule}, nil
+}
+
+// checkIP checks the resolved IP of the domain name against the deny list.
+func (f *filters) checkIP(name, ip string, monitored *[]*RejectedError) error {
+	if m, matched := match(f.rejects, ip); matched && !m.exception {
+		return f.reject(m, "domain/ip", name+"/"+ip, monitored)
+	}
+	return nil
+}
+
+// checkCNAMEs checks the canonical names of the domain name against the deny list, so a domain name cannot
+// bypass the deny list by being an alias of a rejected one. An exception (@@) of the domain name allows its aliases.
+func (f *filters) checkCNAMEs(name string, cnames []string, monitored *[]*RejectedError) error {
+	if len(cnames) == 0 {
+		return nil
+	}
+	if m, _ := match(f.rejects, name); m.exception {
+		return nil
+	}
+
+	for _, cname := range cnames {
+		if m, matched := match(f.rejects, cname); matched && !m.exception {
+			if err := f.reject(m, "cname", name+"/"+cname, monitored); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// filterTypes removes the IPs of the record types (A or AAAA) rejected by the $dnstype rules of the deny list.
+// It returns an error when all the IPs are removed.
+func (f *filters) filterTypes(name string, ips []net.IP, monitored *[]*RejectedError) ([]net.IP, error) {
+	rejected := func(qtype uint16) error {
+		res, ok := f.rejects.MatchRequest(&urlfilter.DNSRequest{Hostname: name, DNSType: qtype})
+		if !ok || res.NetworkRule == nil || res.NetworkRule.Whitelist {
+			return nil
+		}
+
+		m := ruleMatch{rule: res.NetworkRule.String(), list: res.NetworkRule.GetFilterListID()}
+		return f.reject(m, "dnstype", name, monitored)
+	}
+
+	errA, errAAAA := rejected(dns.TypeA), rejected(dns.TypeAAAA)
+	if errA == nil && errAAAA == nil {
+		return ips, nil
+	}
+
+	allowed := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if ipv4 := ip.To4() != nil; ipv4 && errA == nil || !ipv4 && errAAAA == nil {
+			allowed = append(allowed, ip)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, cmp.Or(errA, errAAAA)
+	}
+	return allowed, nil
+}
+
+// FilterIP checks the given IP against the blocked networks and the deny list.
+// The IPs of the hosts are allowed by the blocked networks when they are the ones of the domain name
+// of the context (see WithHost).
+// The rejections of the lists in monitor mode are reported (see OnMonitor) and the IP is allowed.
+func (r *NameResolver) FilterIP(ctx context.Context, ip net.IP) error {
+	if prefix, ok := r.filter.blocked.match(ip); ok && !r.isHostIP(ctx, ip) {
+		return r.stats.record(&RejectedError{Kind: "ip", Rule: prefix.String(), Target: ip.String()})
+	}
+
+	filters := r.current()
+	if m, matched := match(filters.rejects, ip.String()); matched && !m.exception {
+		var monitored []*RejectedError
+		err := filters.reject(m, "ip", ip.String(), &monitored)
+		r.report(monitored)
+		return r.stats.record(err)
+	}
+	return nil
+}
+
+// A ruleMatch is the rule of a filter list matching a host.
+type ruleMatch struct {
+	rule      string
+	list      rules.ListID
+	exception bool
+}
+
+// match returns the rule matching the given host and whether it is an exception (@@).
+func match(engine *urlfilter.DNSEngine, host string) (ruleMatch, bool) {
+	if engine == nil {
+		return ruleMatch{}, false
+	}
+
+	res, ok := engine.Match(host)
+	switch {
+	case !ok:
+		return ruleMatch{}, false
+	case res.NetworkRule != nil:
+		return ruleMatch{
+			rule:      res.NetworkRule.String(),
+			list:      res.NetworkRule.GetFilterListID(),
+			exception: res.NetworkRule.Whitelist,
+		}, true
+	case len(res.HostRulesV4) > 0:
+		return ruleMatch{rule: res.HostRulesV4[0].String(), list: res.HostRulesV4[0].GetFilterListID()}, true
+	case len(res.HostRulesV6) > 0:
+		return ruleMatch{rule: res.HostRulesV6[0].String(), list: res.HostRulesV6[0].GetFilterListID()}, true
+	}
+	return ruleMatch{}, true
+}
+
+// reject returns the rejection of the target by the matching rule.
+// When the list of the rule is in monitor mode, the rejection is added to monitored and nil is returned.
+func (f *filters) reject(m ruleMatch, kind, target string, monitored *[]*RejectedError) error {
+	err := &RejectedError{Kind: kind, Rule: m.rule, List: f.names[m.list], Target: target}
+	if !f.monitor[m.list] {
+		return err
+	}
+
+	err.Kind = "monitor " + kind
+	*monitored = append(*monitored, err)
+	return nil
+}
+
+// MatchingRules returns the rules of the deny list and the allow list matching the given host.
+func (r *NameResolver) MatchingRules(host string) []string {
+	filters := r.current()
+
+	var matches []string
+	if m, ok := match(filters.rejects, host); ok {
+		matches = append(matches, "denylist: "+m.rule)
+	}
+	if m, ok := match(filters.allows, host); ok {
+		matches = append(matches, "allowlist: "+m.rule)
+	}
+	return matches
+}
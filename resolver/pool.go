@@ -0,0 +1,210 @@
+package resolver
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// Strategies used by a Pool to query its upstreams.
+const (
+	// StrategyFailover queries the upstreams one after the other until one answers (default).
+	StrategyFailover = "failover"
+	// StrategyRace queries all the upstreams at once and keeps the first answer.
+	StrategyRace = "race"
+	// StrategyRoundRobin queries the upstreams one after the other, starting from the next one at each query.
+	StrategyRoundRobin = "round_robin"
+)
+
+// Default health tracking of the upstreams of a Pool.
+const (
+	DefaultMaxFails    = 3
+	DefaultFailTimeout = 30 * time.Second
+)
+
+// A PoolConfig holds the settings of a Pool.
+// The yaml tags are the keys of the configuration file of the server.
+type PoolConfig struct {
+	// Strategy is the way the upstreams are queried (StrategyFailover by default).
+	Strategy string `yaml:"nameserver_strategy"`
+	// Retries is the number of times all the upstreams are queried again after they all failed.
+	Retries int `yaml:"nameserver_retries"`
+	// MaxFails is the number of consecutive failures before an upstream is ejected (DefaultMaxFails by default).
+	MaxFails int `yaml:"nameserver_max_fails"`
+	// FailTimeout is the duration of the ejection of a failing upstream (DefaultFailTimeout by default).
+	FailTimeout time.Duration `yaml:"nameserver_fail_timeout"`
+}
+
+// A Pool is an Upstream spreading the queries over several upstreams.
+// The failing upstreams are temporarily ejected from the pool,
+// they are only queried when all the upstreams are ejected.
+type Pool struct {
+	config    PoolConfig
+	upstreams []*member
+	next      atomic.Uint32
+}
+
+type member struct {
+	Upstream
+
+	mu      sync.Mutex
+	fails   int
+	ejected time.Time
+}
+
+// NewPool returns a new Pool for the given upstreams.
+func NewPool(upstreams []Upstream, config PoolConfig) (*Pool, error) {
+	if len(upstreams) == 0 {
+		return nil, errors.New("no upstream")
+	}
+
+	switch config.Strategy {
+	case "":
+		config.Strategy = StrategyFailover
+	case StrategyFailover, StrategyRace, StrategyRoundRobin:
+	default:
+		return nil, errors.Errorf("unsupported nameserver strategy: %q", config.Strategy)
+	}
+	if config.MaxFails <= 0 {
+		config.MaxFails = DefaultMaxFails
+	}
+	if config.FailTimeout <= 0 {
+		config.FailTimeout = DefaultFailTimeout
+	}
+
+	p := &Pool{config: config}
+	for _, upstream := range upstreams {
+		p.upstreams = append(p.upstreams, &member{Upstream: upstream})
+	}
+	return p, nil
+}
+
+// Exchange sends the query to the upstreams according to the strategy of the pool.
+func (p *Pool) Exchange(ctx context.Context, query *dns.Msg) (answer *dns.Msg, err error) {
+	for range p.config.Retries + 1 {
+		members := p.members()
+
+		if p.config.Strategy == StrategyRace {
+			answer, err = p.race(ctx, members, query)
+		} else {
+			answer, err = p.sequence(ctx, members, query)
+		}
+
+		if err == nil && !failed(answer) || ctx.Err() != nil {
+			return answer, err
+		}
+	}
+	return answer, err
+}
+
+func (p *Pool) String() string {
+	names := make([]string, 0, len(p.upstreams))
+	for _, m := range p.upstreams {
+		names = append(names, m.String())
+	}
+	return strings.Join(names, ", ")
+}
+
+// members returns the healthy upstreams in the order of the strategy.
+func (p *Pool) members() []*member {
+	now := time.Now()
+
+	start := 0
+	if p.config.Strategy == StrategyRoundRobin {
+		start = int(p.next.Add(1)-1) % len(p.upstreams)
+	}
+
+	members := make([]*member, 0, len(p.upstreams))
+	for i := range p.upstreams {
+		m := p.upstreams[(start+i)%len(p.upstreams)]
+		if m.healthy(now) {
+			members = append(members, m)
+		}
+	}
+
+	if len(members) == 0 {
+		// All the upstreams are ejected, better try them than fail.
+		return p.upstreams
+	}
+	return members
+}
+
+// sequence queries the upstreams one after the other until one answers.
+// The last answer is returned when all the upstreams answer with a server failure.
+func (p *Pool) sequence(ctx context.Context, members []*member, query *dns.Msg) (answer *dns.Msg, err error) {
+	for _, m := range members {
+		answer, err = m.exchange(ctx, query, p.config)
+		if err == nil && !failed(answer) || ctx.Err() != nil {
+			return answer, err
+		}
+	}
+	return answer, err
+}
+
+// race queries all the upstreams at once and returns the first successful answer.
+func (p *Pool) race(ctx context.Context, members []*member, query *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		answer *dns.Msg
+		err    error
+	}
+
+	results := make(chan result, len(members))
+	for _, m := range members {
+		go func() {
+			answer, err := m.exchange(ctx, query.Copy(), p.config)
+			results <- result{answer: answer, err: err}
+		}()
+	}
+
+	var r result
+	for range members {
+		r = <-results
+		if r.err == nil && !failed(r.answer) {
+			return r.answer, nil
+		}
+	}
+	return r.answer, r.err
+}
+
+func (m *member) exchange(ctx context.Context, query *dns.Msg, config PoolConfig) (*dns.Msg, error) {
+	answer, err := m.Exchange(ctx, query)
+	if err != nil && ctx.Err() != nil {
+		// Cancelled by the caller or by a faster upstream, not a failure of the upstream.
+		return answer, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err != nil || failed(answer) {
+		m.fails++
+		if m.fails >= config.MaxFails {
+			m.fails = 0
+			m.ejected = time.Now().Add(config.FailTimeout)
+		}
+		return answer, err
+	}
+
+	m.fails = 0
+	return answer, nil
+}
+
+func (m *member) healthy(now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return now.After(m.ejected)
+}
+
+// failed returns true when the answer is a failure of the upstream.
+func failed(answer *dns.Msg) bool {
+	return answer.Rcode == dns.RcodeServerFailure || answer.Rcode == dns.RcodeRefused
+}
@@ -0,0 +1,248 @@
+package resolver
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// A fakeUpstream answers with its rcode (or fails with its error) after its delay.
+type fakeUpstream struct {
+	name  string
+	delay time.Duration
+
+	mu    sync.Mutex
+	rcode int
+	err   error
+	calls int
+}
+
+func (u *fakeUpstream) Exchange(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	u.mu.Lock()
+	u.calls++
+	rcode, err := u.rcode, u.err
+	u.mu.Unlock()
+
+	select {
+	case <-time.After(u.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	answer := new(dns.Msg)
+	answer.SetRcode(query, rcode)
+	answer.Ns = []dns.RR{&dns.TXT{Hdr: dns.RR_Header{Name: "upstream.", Rrtype: dns.TypeTXT, Class: dns.ClassINET}, Txt: []string{u.name}}}
+	return answer, nil
+}
+
+func (u *fakeUpstream) String() string {
+	return u.name
+}
+
+func (u *fakeUpstream) set(rcode int, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.rcode, u.err = rcode, err
+}
+
+func (u *fakeUpstream) count() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	n := u.calls
+	u.calls = 0
+	return n
+}
+
+// exchange queries the pool and returns the name of the answering upstream.
+func exchange(t *testing.T, p *Pool) string {
+	t.Helper()
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+
+	answer, err := p.Exchange(context.Background(), query)
+	if err != nil {
+		return "error"
+	}
+	if failed(answer) {
+		return "failed"
+	}
+	return answer.Ns[0].(*dns.TXT).Txt[0]
+}
+
+func newFakePool(t *testing.T, config PoolConfig, upstreams ...*fakeUpstream) *Pool {
+	t.Helper()
+
+	members := make([]Upstream, 0, len(upstreams))
+	for _, u := range upstreams {
+		members = append(members, u)
+	}
+
+	p, err := NewPool(members, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestPoolFailover(t *testing.T) {
+	a := &fakeUpstream{name: "a"}
+	b := &fakeUpstream{name: "b"}
+	c := &fakeUpstream{name: "c"}
+	p := newFakePool(t, PoolConfig{MaxFails: 100}, a, b, c)
+
+	if name := exchange(t, p); name != "a" {
+		t.Errorf("got answer from %s, expected a", name)
+	}
+
+	a.set(dns.RcodeServerFailure, nil)
+	b.set(0, errors.New("timeout"))
+	if name := exchange(t, p); name != "c" {
+		t.Errorf("got answer from %s, expected c", name)
+	}
+
+	// NXDOMAIN is an answer, not a failure of the upstream.
+	a.set(dns.RcodeNameError, nil)
+	if name := exchange(t, p); name != "a" {
+		t.Errorf("got answer from %s, expected a", name)
+	}
+
+	a.set(dns.RcodeRefused, nil)
+	c.set(dns.RcodeServerFailure, nil)
+	if name := exchange(t, p); name != "failed" {
+		t.Errorf("got answer from %s, expected the last server failure", name)
+	}
+}
+
+func TestPoolRetries(t *testing.T) {
+	a := &fakeUpstream{name: "a", rcode: dns.RcodeServerFailure}
+	b := &fakeUpstream{name: "b", rcode: dns.RcodeServerFailure}
+	p := newFakePool(t, PoolConfig{Retries: 2, MaxFails: 100}, a, b)
+
+	if name := exchange(t, p); name != "failed" {
+		t.Errorf("got answer from %s, expected a failure", name)
+	}
+	if n := a.count() + b.count(); n != 6 {
+		t.Errorf("upstreams queried %d times, expected 6", n)
+	}
+}
+
+func TestPoolRace(t *testing.T) {
+	slow := &fakeUpstream{name: "slow", delay: time.Second}
+	fast := &fakeUpstream{name: "fast", delay: 10 * time.Millisecond}
+	broken := &fakeUpstream{name: "broken", rcode: dns.RcodeServerFailure}
+	p := newFakePool(t, PoolConfig{Strategy: StrategyRace, MaxFails: 1}, slow, broken, fast)
+
+	start := time.Now()
+	if name := exchange(t, p); name != "fast" {
+		t.Errorf("got answer from %s, expected fast", name)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("race waited for the slow upstream: %v", elapsed)
+	}
+
+	// The cancelled slow upstream is not counted as failing, unlike the broken one.
+	if !p.upstreams[0].healthy(time.Now()) {
+		t.Error("slow upstream ejected after being cancelled")
+	}
+	if p.upstreams[1].healthy(time.Now()) {
+		t.Error("broken upstream not ejected")
+	}
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	a := &fakeUpstream{name: "a"}
+	b := &fakeUpstream{name: "b"}
+	c := &fakeUpstream{name: "c"}
+	p := newFakePool(t, PoolConfig{Strategy: StrategyRoundRobin}, a, b, c)
+
+	for i, expected := range []string{"a", "b", "c", "a", "b"} {
+		if name := exchange(t, p); name != expected {
+			t.Errorf("query %d: got answer from %s, expected %s", i, name, expected)
+		}
+	}
+
+	// A failing upstream hands over to the next one.
+	b.set(dns.RcodeServerFailure, nil)
+	for i, expected := range []string{"c", "a", "c"} {
+		if name := exchange(t, p); name != expected {
+			t.Errorf("query %d: got answer from %s, expected %s", i, name, expected)
+		}
+	}
+}
+
+func TestPoolEjection(t *testing.T) {
+	a := &fakeUpstream{name: "a", rcode: dns.RcodeServerFailure}
+	b := &fakeUpstream{name: "b"}
+	p := newFakePool(t, PoolConfig{MaxFails: 2, FailTimeout: 100 * time.Millisecond}, a, b)
+
+	for range 2 {
+		if name := exchange(t, p); name != "b" {
+			t.Errorf("got answer from %s, expected b", name)
+		}
+	}
+	if n := a.count(); n != 2 {
+		t.Errorf("a queried %d times, expected 2", n)
+	}
+
+	// Ejected after MaxFails consecutive failures, even once it recovered.
+	a.set(dns.RcodeSuccess, nil)
+	if name := exchange(t, p); name != "b" {
+		t.Errorf("got answer from %s, expected b", name)
+	}
+	if n := a.count(); n != 0 {
+		t.Errorf("ejected upstream queried %d times", n)
+	}
+
+	// Back in the pool after FailTimeout.
+	time.Sleep(150 * time.Millisecond)
+	if name := exchange(t, p); name != "a" {
+		t.Errorf("got answer from %s, expected a", name)
+	}
+}
+
+func TestPoolAllEjected(t *testing.T) {
+	a := &fakeUpstream{name: "a", err: errors.New("timeout")}
+	b := &fakeUpstream{name: "b", err: errors.New("timeout")}
+	p := newFakePool(t, PoolConfig{MaxFails: 1, FailTimeout: time.Hour}, a, b)
+
+	if name := exchange(t, p); name != "error" {
+		t.Errorf("got answer from %s, expected an error", name)
+	}
+
+	// All the upstreams are ejected, they are still queried.
+	b.set(dns.RcodeSuccess, nil)
+	if name := exchange(t, p); name != "b" {
+		t.Errorf("got answer from %s, expected b", name)
+	}
+}
+
+func TestPoolCancellation(t *testing.T) {
+	a := &fakeUpstream{name: "a", delay: time.Second}
+	b := &fakeUpstream{name: "b"}
+	p := newFakePool(t, PoolConfig{MaxFails: 1}, a, b)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	if _, err := p.Exchange(ctx, query); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, expected %v", err, context.DeadlineExceeded)
+	}
+	if b.count() != 0 {
+		t.Error("next upstream queried after the cancellation")
+	}
+	if !p.upstreams[0].healthy(time.Now()) {
+		t.Error("upstream ejected after a cancellation")
+	}
+}
@@ -9,143 +9,312 @@ import (
 
 	"github.com/AdguardTeam/urlfilter"
 	"github.com/AdguardTeam/urlfilter/filterlist"
-	"github.com/dgraph-io/ristretto/v2"
+	"github.com/AdguardTeam/urlfilter/rules"
+	"github.com/miekg/dns"
 	"github.com/pkg/errors"
 )
 
-// CacheTTL is the duration before a domain name resolution is evict form the cache.
+// CacheTTL is the default maximum duration before a domain name resolution is evict form the cache.
 const CacheTTL = 12 * time.Hour
 
+// DefaultCacheSize is the default maximum number of domain name resolutions kept in the cache.
+const DefaultCacheSize = 5000
+
+// DefaultNegativeCacheSize is the default maximum number of rejected and failed resolutions kept in the cache.
+const DefaultNegativeCacheSize = 1000
+
+// DefaultNegativeTTL is the default maximum duration a rejected or failed resolution is cached.
+const DefaultNegativeTTL = time.Minute
+
+// ResolvConf is the file of the name servers of the host, queried when no name server is configured.
+const ResolvConf = "/etc/resolv.conf"
+
+// SystemHostsFile is the hosts file of the host, looked up before the name servers of ResolvConf.
+const SystemHostsFile = "/etc/hosts"
+
+// HostResolverTTL is the TTL given to the resolutions of the host resolver which does not expose the DNS TTLs.
+const HostResolverTTL = 5 * time.Minute
+
+// InlineListID is the filter list ID of the deny list given to New.
+const InlineListID = 42
+
+// RuntimeListID is the filter list ID of the deny rules added at runtime.
+const RuntimeListID = 43
+
 // ErrHostRejected is returned when the host has been flagged as unwanted.
 var ErrHostRejected = errors.New("rejected host")
 
-// A NameResolver is used for name resolution.
+// A Config holds the settings of a NameResolver.
+// The yaml tags are the keys of the configuration file of the server.
+type Config struct {
+	// NameServer forces the Domain Name Server instead the host one.
+	// Without name server, the ones of ResolvConf are queried after the SystemHostsFile
+	// (the host resolver is used when ResolvConf cannot be read, see NewHostResolver).
+	// See UpstreamConfig for the supported addresses (plain DNS, DNS-over-TLS and DNS-over-HTTPS).
+	NameServer string `yaml:"force_nameserver"`
+	// NameServers is the list of Domain Name Servers used in addition of NameServer.
+	NameServers []string `yaml:"nameservers"`
+	// NameServerTimeout is the maximum duration of a query to a name server (DefaultUpstreamTimeout by default).
+	NameServerTimeout time.Duration `yaml:"nameserver_timeout"`
+	// Pool holds the way the name servers are queried.
+	Pool PoolConfig `yaml:",inline"`
+	// NameServerBootstrap is the list of IPs used to connect to an encrypted name server given by its hostname.
+	NameServerBootstrap []string `yaml:"nameserver_bootstrap"`
+	// NameServerCA is the PEM file of the certificate authorities verifying an encrypted name server
+	// (system pool by default).
+	NameServerCA string `yaml:"nameserver_ca"`
+	// Cache holds the settings of the resolutions cache.
+	Cache CacheConfig `yaml:",inline"`
+	// Policy is the policy applied to the hosts (PolicyDenyList by default).
+	Policy string `yaml:"policy"`
+	// AllowList is the list of urlfilter patterns allowed by the allowlist policy.
+	AllowList []string `yaml:"allowlist" env:"lines"`
+	// DenyList is the list of urlfilter patterns rejected by the policy.
+	DenyList []string `yaml:"denylist" env:"lines"`
+	// BlockPrivate rejects the domain names resolved to one of the PrivateNetworks.
+	// The resolved IPs and the dialed addresses are verified, the IPs of the Hosts are allowed for their domain names only.
+	BlockPrivate bool `yaml:"block_private"`
+	// BlockedNetworks is the list of CIDRs rejected in addition of the PrivateNetworks.
+	BlockedNetworks []string `yaml:"blocked_networks"`
+	// Monitor enables the monitor mode of all the deny lists: the rejections are reported but the hosts are allowed.
+	// See List.Monitor to enable it per list.
+	Monitor bool `yaml:"denylist_monitor"`
+}
+
+// A NameResolver is the default Resolver, it chains the following layers:
+// the normalization of the domain names, a Cache, the policy check of the Filter, the Hosts, the check of the resolved IPs and the name servers.
+//
+// The OnMonitor hook can be set after New and before the first resolution.
 type NameResolver struct {
-	mu            sync.Mutex
-	resolver      *net.Resolver
-	rejects       *urlfilter.DNSEngine
-	rejectedByIPs map[string]string
-	overrides     map[string]net.IP
-	cache         *ristretto.Cache[string, net.IP]
+	// OnMonitor is called with the rejections of the lists in monitor mode, at each resolution or check
+	// of a host they apply to (e.g. to log them).
+	OnMonitor func(*RejectedError)
+
+	filter *Filter
+	hosts  *Hosts
+	cache  *Cache
+	stats  *Stats
+	chain  Resolver
+
+	rmu   sync.Mutex
+	rules map[string]RuntimeRule
+}
+
+type filters struct {
+	policy  string
+	rejects *urlfilter.DNSEngine
+	urls    *urlfilter.NetworkEngine
+	allows  *urlfilter.DNSEngine
+	names   map[rules.ListID]string // By list ID
+	monitor map[rules.ListID]bool   // Lists in monitor mode
 }
 
 // New return a new NameResolver.
-func New(nameserver string, rejects []string) (*NameResolver, error) {
-	rs, err := filterlist.NewRuleStorage([]filterlist.Interface{
-		filterlist.NewString(&filterlist.StringConfig{
-			ID:        42,
-			RulesText: strings.Join(rejects, "\n"),
-		}),
-	})
+func New(config Config) (*NameResolver, error) {
+	filter, err := NewFilter(config)
+	if err != nil {
+		return nil, err
+	}
+
+	cache, err := NewCache(config.Cache)
 	if err != nil {
 		return nil, err
 	}
 
-	cache, err := ristretto.NewCache(&ristretto.Config[string, net.IP]{
-		NumCounters: 50_000,
-		MaxCost:     5000,
-		BufferItems: 64,
-	})
+	hosts, err := NewHosts(nil)
 	if err != nil {
 		return nil, err
 	}
 
-	resolver := new(net.Resolver)
-	if nameserver != "" {
-		resolver.PreferGo = true
-		resolver.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
-			d := net.Dialer{
-				Timeout: 500 * time.Millisecond,
+	upstream := NewHostResolver()
+	nameservers := config.NameServers
+	if config.NameServer != "" {
+		nameservers = append([]string{config.NameServer}, nameservers...)
+	}
+
+	var system *Hosts
+	if len(nameservers) == 0 {
+		// The name servers of the host are queried directly for their TTLs and CNAME chains,
+		// the host resolver is only used when they are unknown (e.g. no resolv.conf).
+		if nameservers, err = SystemNameServers(); err == nil {
+			system = systemHosts()
+		}
+	}
+	if len(nameservers) > 0 {
+		upstreams := make([]Upstream, 0, len(nameservers))
+		for _, nameserver := range nameservers {
+			u, err := NewUpstream(UpstreamConfig{
+				Address:   nameserver,
+				Bootstrap: config.NameServerBootstrap,
+				CA:        config.NameServerCA,
+				Timeout:   config.NameServerTimeout,
+			})
+			if err != nil {
+				return nil, err
 			}
-			return d.DialContext(ctx, network, nameserver)
+			upstreams = append(upstreams, u)
+		}
+
+		pool, err := NewPool(upstreams, config.Pool)
+		if err != nil {
+			return nil, err
+		}
+		upstream = NewUpstreamResolver(pool)
+		if system != nil {
+			upstream = system.Middleware(upstream)
 		}
 	}
 
 	return &NameResolver{
-		resolver:      resolver,
-		rejects:       urlfilter.NewDNSEngine(rs),
-		rejectedByIPs: map[string]string{},
-		overrides:     map[string]net.IP{},
-		cache:         cache,
+		filter: filter,
+		hosts:  hosts,
+		cache:  cache,
+		stats:  NewStats(),
+		chain:  Chain(upstream, Normalize, cache.Middleware, filter.Names, hosts.Middleware, filter.IPs),
 	}, nil
 }
 
-// OverrideHost adds an host override.
-func (r *NameResolver) OverrideHost(host string, ip string) error {
-	override := net.ParseIP(ip)
-	if override == nil {
-		return errors.Errorf("failed to parse ip: %q", ip)
+// SystemNameServers returns the addresses of the name servers of ResolvConf.
+func SystemNameServers() ([]string, error) {
+	config, err := dns.ClientConfigFromFile(ResolvConf)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read name servers")
+	}
+	if len(config.Servers) == 0 {
+		return nil, errors.Errorf("no name server in %s", ResolvConf)
 	}
 
-	r.overrides[host] = override
-	return nil
+	nameservers := make([]string, 0, len(config.Servers))
+	for _, server := range config.Servers {
+		nameservers = append(nameservers, net.JoinHostPort(server, config.Port))
+	}
+	return nameservers, nil
 }
 
-// Resolve returns the ip for the given domain name.
-func (r *NameResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
-	if ip, ok := r.cache.Get(name); ok {
-		return ctx, ip, nil
+// systemHosts returns the Hosts of SystemHostsFile, nil when it cannot be loaded.
+func systemHosts() *Hosts {
+	entries, err := LoadHostsFile(SystemHostsFile)
+	if err != nil {
+		return nil
 	}
 
-	if ip, ok := r.isRejectedByIP(name); ok {
-		return ctx, nil, errors.Wrapf(ErrHostRejected, "[cached domain/ip] %s/%s", name, ip)
+	hosts, err := NewHosts(entries)
+	if err != nil {
+		return nil
 	}
+	return hosts
+}
 
-	//
-
-	if rules, ok := r.rejects.Match(name); ok {
-		if rules.NetworkRule != nil {
-			return ctx, nil, errors.Wrapf(ErrHostRejected, "[domain][%s] %s", rules.NetworkRule.String(), name)
-		}
-		return ctx, nil, errors.Wrapf(ErrHostRejected, "[domain] %s", name)
+// SetLists replaces the deny lists loaded in addition of the deny list given to New.
+// The resolution caches are cleared so the new rules apply immediately.
+func (r *NameResolver) SetLists(lists []List) error {
+	if err := r.filter.SetLists(lists); err != nil {
+		return err
 	}
 
-	if ip, ok := r.overrides[name]; ok {
-		return ctx, ip, nil
+	r.cache.Flush()
+	return nil
+}
+
+// OverrideHost adds an host override. See Hosts for the wildcards.
+func (r *NameResolver) OverrideHost(host string, ips ...string) error {
+	if err := r.hosts.Add(host, ips...); err != nil {
+		return err
 	}
 
-	addrs, err := r.resolver.LookupIPAddr(context.Background(), name)
+	r.cache.Flush()
+	return nil
+}
+
+// SetHosts replaces all the host overrides. See Hosts for the wildcards.
+func (r *NameResolver) SetHosts(entries map[string][]string) error {
+	hosts, err := NewHosts(entries)
 	if err != nil {
-		return ctx, nil, errors.Wrapf(err, "[resolve] %s", name)
-	}
-	if len(addrs) == 0 {
-		return ctx, nil, errors.Errorf("[resolve] no IP for %s", name)
+		return err
 	}
 
-	addr := addrs[0]
-	for _, a := range addrs {
-		if a.IP.To4() != nil {
-			addr = a // Prefer IPv4
-			break
-		}
-	}
+	r.hosts.Replace(hosts)
+	r.cache.Flush()
+	return nil
+}
 
-	if rules, ok := r.rejects.Match(addr.IP.String()); ok {
-		r.setRejectedByIP(name, addr.IP)
-		if rules.NetworkRule != nil {
-			return ctx, nil, errors.Wrapf(ErrHostRejected, "[domain/ip][%s] %s/%s", rules.NetworkRule.String(), rules.NetworkRule.String(), name)
-		}
-		return ctx, nil, errors.Wrapf(ErrHostRejected, "[domain/ip] %s/%s", name, addr.IP)
+// Resolve resolves the given domain name and checks it against the policy.
+// The concurrent resolutions of a name are coalesced and cancelled when all their contexts are done.
+func (r *NameResolver) Resolve(ctx context.Context, name string) (*Result, error) {
+	result, err := r.chain.Resolve(ctx, name)
+	if err != nil {
+		return nil, r.stats.record(err)
 	}
 
-	//
+	r.stats.allowed(result.Rules)
+	r.report(result.Monitored)
+	return result, nil
+}
 
-	r.cache.SetWithTTL(name, addr.IP, 1, CacheTTL)
-	r.cache.Wait()
-	return ctx, addr.IP, nil
+// Stats returns the hit counters of the rules.
+func (r *NameResolver) Stats() *Stats {
+	return r.stats
 }
 
-func (r *NameResolver) isRejectedByIP(name string) (string, bool) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+// report counts and reports the rejections of the lists in monitor mode.
+func (r *NameResolver) report(monitored []*RejectedError) {
+	for _, rejected := range monitored {
+		r.stats.record(rejected)
+		if r.OnMonitor != nil {
+			r.OnMonitor(rejected)
+		}
+	}
+}
 
-	ip, ok := r.rejectedByIPs[name]
-	return ip, ok
+func (r *NameResolver) current() *filters {
+	return r.filter.current()
 }
 
-func (r *NameResolver) setRejectedByIP(name string, ip net.IP) {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+func newFilters(config Config, lists []List) (*filters, error) {
+	fls := []filterlist.Interface{
+		filterlist.NewString(&filterlist.StringConfig{
+			ID:        InlineListID,
+			RulesText: strings.Join(config.DenyList, "\n"),
+		}),
+	}
+	for _, list := range lists {
+		fls = append(fls, filterlist.NewBytes(&filterlist.BytesConfig{
+			ID:             list.ID,
+			RulesText:      list.Rules,
+			IgnoreCosmetic: true,
+		}))
+	}
+
+	rs, err := filterlist.NewRuleStorage(fls)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &filters{
+		policy:  config.Policy,
+		rejects: urlfilter.NewDNSEngine(rs),
+		urls:    urlfilter.NewNetworkEngine(rs),
+		names:   map[rules.ListID]string{InlineListID: "denylist"},
+		monitor: map[rules.ListID]bool{InlineListID: config.Monitor},
+	}
+	for _, list := range lists {
+		f.names[list.ID] = list.Name
+		f.monitor[list.ID] = list.Monitor || config.Monitor && list.ID != RuntimeListID
+	}
+
+	if config.Policy == PolicyAllowList {
+		rs, err := filterlist.NewRuleStorage([]filterlist.Interface{
+			filterlist.NewString(&filterlist.StringConfig{
+				ID:        InlineListID,
+				RulesText: strings.Join(config.AllowList, "\n"),
+			}),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		f.allows = urlfilter.NewDNSEngine(rs)
+	}
 
-	r.rejectedByIPs[name] = ip.String()
+	return f, nil
 }
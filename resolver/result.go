@@ -0,0 +1,57 @@
+package resolver
+
+import (
+	"net"
+	"time"
+)
+
+// Cache statuses of a Result.
+const (
+	// CacheMiss is the status of a resolution made by the name servers, the hosts or an IP literal.
+	CacheMiss = "miss"
+	// CacheHit is the status of a resolution served by the cache.
+	CacheHit = "hit"
+	// CacheStale is the status of an expired resolution served while it is resolved again.
+	CacheStale = "stale"
+)
+
+// A Result is the result of a name resolution.
+// It is shared by the concurrent resolutions of a name and must not be modified.
+type Result struct {
+	// Name is the resolved domain name.
+	Name string
+	// IP is the IP to dial, an IPv4 is preferred.
+	IP net.IP
+	// IPs is the list of all the IPs of the domain name.
+	IPs []net.IP
+	// CNAMEs is the chain of canonical names of the domain name, in resolution order.
+	// It includes the names given by the $dnsrewrite rules.
+	CNAMEs []string
+	// Rules is the list of the rules allowing the domain name
+	// (e.g. "allowlist: ||example.com^" or "denylist: @@||example.com^")
+	// and the $dnsrewrite rules applied to the domain name (e.g. "dnsrewrite: ||example.com^$dnsrewrite=1.2.3.4").
+	Rules []string
+	// Monitored is the list of the rejections of the lists in monitor mode, the domain name is allowed.
+	Monitored []*RejectedError
+	// TTL is the duration the resolution can be cached, zero when it must not be cached.
+	TTL time.Duration
+	// Cache is the cache status of the resolution: CacheMiss, CacheHit or CacheStale.
+	Cache string
+}
+
+// with returns a copy of the result with the given cache status.
+func (r *Result) with(cache string) *Result {
+	res := *r
+	res.Cache = cache
+	return &res
+}
+
+// preferIPv4 returns the first IPv4 of the given IPs, or the first IP when there is no IPv4.
+func preferIPv4(ips []net.IP) net.IP {
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip
+		}
+	}
+	return ips[0]
+}
@@ -0,0 +1,55 @@
+package resolver
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// A rewrite is the destination of a domain name given by the $dnsrewrite rules of the deny list.
+type rewrite struct {
+	// rules is the list of the applied rules.
+	rules []string
+	// cname is the domain name resolved instead of the requested one.
+	cname string
+	// ips is the list of IPs of the domain name.
+	ips []net.IP
+}
+
+// rewrite returns the destination given by the $dnsrewrite rules matching the domain name, nil when there is none.
+// A rewritten CNAME takes precedence over the rewritten A and AAAA records, the other records are ignored.
+// A rewritten response code (e.g. NXDOMAIN or REFUSED) or an empty answer rejects the domain name.
+// The rules of the lists in monitor mode are not applied, they are added to monitored.
+func (f *filters) rewrite(name string, monitored *[]*RejectedError) (*rewrite, error) {
+	res, _ := f.rejects.Match(name)
+
+	rw := new(rewrite)
+	for _, rule := range res.DNSRewrites() {
+		m := ruleMatch{rule: rule.String(), list: rule.GetFilterListID()}
+		if err := f.reject(m, "dnsrewrite", name, monitored); err == nil {
+			continue // Monitored
+		}
+
+		switch dr := rule.DNSRewrite; {
+		case dr.NewCNAME != "":
+			return &rewrite{
+				rules: []string{m.rule},
+				cname: strings.ToLower(strings.TrimSuffix(dr.NewCNAME, ".")),
+			}, nil
+		case dr.RCode != dns.RcodeSuccess || dr.RRType == dns.TypeNone:
+			return nil, &RejectedError{Kind: "dnsrewrite", Rule: m.rule, List: f.names[m.list], Target: name}
+		case dr.RRType == dns.TypeA || dr.RRType == dns.TypeAAAA:
+			if addr, ok := dr.Value.(netip.Addr); ok {
+				rw.ips = append(rw.ips, addr.AsSlice())
+				rw.rules = append(rw.rules, m.rule)
+			}
+		}
+	}
+
+	if len(rw.ips) == 0 {
+		return nil, nil
+	}
+	return rw, nil
+}
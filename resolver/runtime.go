@@ -0,0 +1,213 @@
+package resolver
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/urlfilter/rules"
+	"github.com/pkg/errors"
+)
+
+// A RuntimeRule is a deny rule added while running (e.g. to block a domain during an incident).
+type RuntimeRule struct {
+	// Rule is the text of the rule.
+	Rule string `json:"rule"`
+	// Created is the time the rule was added.
+	Created time.Time `json:"created"`
+	// Expires is the time the rule expires, zero when it never expires.
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+func (rule RuntimeRule) expired(now time.Time) bool {
+	return !rule.Expires.IsZero() && !now.Before(rule.Expires)
+}
+
+// AddRule adds a deny rule layered on the deny lists, it expires after ttl unless ttl is zero.
+// Adding an existing rule replaces its expiration. The resolution caches are cleared so the rule applies immediately.
+func (r *NameResolver) AddRule(rule string, ttl time.Duration) (RuntimeRule, error) {
+	rule = strings.TrimSpace(rule)
+	if err := validateRuntimeRule(rule); err != nil {
+		return RuntimeRule{}, err
+	}
+	if ttl < 0 {
+		return RuntimeRule{}, errors.Errorf("invalid rule TTL %s", ttl)
+	}
+
+	r.rmu.Lock()
+	defer r.rmu.Unlock()
+
+	now := time.Now()
+	added := RuntimeRule{Rule: rule, Created: now}
+	if ttl > 0 {
+		added.Expires = now.Add(ttl)
+	}
+
+	rules := r.copyRules()
+	rules[rule] = added
+	return added, r.applyRules(rules)
+}
+
+// RemoveRule removes a deny rule added by AddRule, it returns false when the rule does not exist.
+func (r *NameResolver) RemoveRule(rule string) (bool, error) {
+	rule = strings.TrimSpace(rule)
+
+	r.rmu.Lock()
+	defer r.rmu.Unlock()
+
+	if _, ok := r.rules[rule]; !ok {
+		return false, nil
+	}
+
+	rules := r.copyRules()
+	delete(rules, rule)
+	return true, r.applyRules(rules)
+}
+
+// ExpireRules removes the expired deny rules added by AddRule and returns the number of removed rules.
+func (r *NameResolver) ExpireRules() (int, error) {
+	r.rmu.Lock()
+	defer r.rmu.Unlock()
+
+	now := time.Now()
+	rules := r.copyRules()
+	for text, rule := range rules {
+		if rule.expired(now) {
+			delete(rules, text)
+		}
+	}
+
+	n := len(r.rules) - len(rules)
+	if n == 0 {
+		return 0, nil
+	}
+	return n, r.applyRules(rules)
+}
+
+// RuntimeRules returns the deny rules added by AddRule, sorted by creation time.
+func (r *NameResolver) RuntimeRules() []RuntimeRule {
+	r.rmu.Lock()
+	rules := make([]RuntimeRule, 0, len(r.rules))
+	for _, rule := range r.rules {
+		rules = append(rules, rule)
+	}
+	r.rmu.Unlock()
+
+	sort.Slice(rules, func(i, j int) bool {
+		if !rules[i].Created.Equal(rules[j].Created) {
+			return rules[i].Created.Before(rules[j].Created)
+		}
+		return rules[i].Rule < rules[j].Rule
+	})
+	return rules
+}
+
+// SaveRules writes the deny rules added by AddRule to the given file.
+// The file is replaced atomically so a crash cannot leave a partial state.
+func (r *NameResolver) SaveRules(filename string) error {
+	rules := r.RuntimeRules()
+	err := writeFile(filename, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(rules)
+	})
+	return errors.Wrap(err, "could not write rules state")
+}
+
+// LoadRules replaces the deny rules added by AddRule by the ones of the given file written by SaveRules.
+// The expired rules are skipped. It returns the number of loaded rules, a missing file is not an error.
+func (r *NameResolver) LoadRules(filename string) (int, error) {
+	f, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "could not read rules state")
+	}
+	defer f.Close()
+
+	var saved []RuntimeRule
+	if err = json.NewDecoder(f).Decode(&saved); err != nil {
+		return 0, errors.Wrap(err, "could not decode rules state")
+	}
+
+	now := time.Now()
+	rules := map[string]RuntimeRule{}
+	for _, rule := range saved {
+		if rule.expired(now) {
+			continue
+		}
+		if err = validateRuntimeRule(rule.Rule); err != nil {
+			return 0, errors.Wrapf(err, "%s", filename)
+		}
+		rules[rule.Rule] = rule
+	}
+
+	r.rmu.Lock()
+	defer r.rmu.Unlock()
+
+	return len(rules), r.applyRules(rules)
+}
+
+// FlushCache clears the resolution caches, both positive and negative.
+func (r *NameResolver) FlushCache() {
+	r.cache.Flush()
+}
+
+// copyRules returns a copy of the runtime rules, r.rmu must be held.
+func (r *NameResolver) copyRules() map[string]RuntimeRule {
+	rules := make(map[string]RuntimeRule, len(r.rules))
+	for text, rule := range r.rules {
+		rules[text] = rule
+	}
+	return rules
+}
+
+// applyRules replaces the runtime rules and clears the resolution caches, r.rmu must be held.
+func (r *NameResolver) applyRules(rules map[string]RuntimeRule) error {
+	texts := make([]string, 0, len(rules))
+	for text := range rules {
+		texts = append(texts, text)
+	}
+	sort.Strings(texts)
+
+	if err := r.filter.SetRuntimeRules(texts); err != nil {
+		return err
+	}
+
+	r.rules = rules
+	r.cache.Flush()
+	return nil
+}
+
+// validateRuntimeRule returns an error when the given rule is not a single deny rule:
+// a host rule (e.g. example.org or 0.0.0.0 example.org) or a network rule that is neither an exception (@@)
+// nor a $badfilter disabling the other rules.
+func validateRuntimeRule(rule string) error {
+	if strings.ContainsAny(rule, "\r\n") {
+		return errors.Errorf("invalid rule %q: multiple lines", rule)
+	}
+
+	r, err := rules.NewRule(rule, RuntimeListID)
+	if err != nil {
+		return errors.Wrapf(err, "invalid rule %q", rule)
+	}
+
+	switch r := r.(type) {
+	case nil:
+		return errors.Errorf("invalid rule %q: empty or comment", rule)
+	case *rules.HostRule:
+		return nil
+	case *rules.NetworkRule:
+		if r.Whitelist {
+			return errors.Errorf("invalid rule %q: exception rules are not allowed", rule)
+		}
+		if r.IsOptionEnabled(rules.OptionBadfilter) {
+			return errors.Errorf("invalid rule %q: $badfilter rules are not allowed", rule)
+		}
+		return nil
+	default:
+		return errors.Errorf("invalid rule %q: not a host or network rule", rule)
+	}
+}
@@ -0,0 +1,101 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestValidateRuntimeRule(t *testing.T) {
+	tests := []struct {
+		rule  string
+		valid bool
+	}{
+		{"example.org", true},
+		{"0.0.0.0 example.org", true},
+		{"||example.org^", true},
+		{"||example.org^$important", true},
+		{"/ads[0-9]+/", true},
+		{"@@||evil.test^", false},
+		{"@@example.org", false},
+		{"||example.org^$badfilter", false},
+		{"", false},
+		{"! comment", false},
+		{"example.org##.ad", false},
+		{"||a.test^\n@@||b.test^", false},
+	}
+
+	for _, test := range tests {
+		err := validateRuntimeRule(test.rule)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("validateRuntimeRule(%q) = %v, expected valid: %v", test.rule, err, test.valid)
+		}
+	}
+}
+
+func TestRuntimeRules(t *testing.T) {
+	r, err := New(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.SetHosts(map[string][]string{"example.org": {"192.0.2.1"}, "example.com": {"192.0.2.2"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	rejected := func(name string) bool {
+		_, err := r.Resolve(context.Background(), name)
+		return errors.Is(err, ErrHostRejected)
+	}
+
+	// Host rule, as in the denylist
+	if _, err = r.AddRule("example.org", 0); err != nil {
+		t.Fatal(err)
+	}
+	if !rejected("example.org") {
+		t.Error("example.org is not rejected by its host rule")
+	}
+
+	if _, err = r.AddRule("@@||example.org^", 0); err == nil {
+		t.Error("exception rule added")
+	}
+	if !rejected("example.org") {
+		t.Error("example.org is allowed by an exception rule")
+	}
+
+	if _, err = r.AddRule("||example.com^", 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if !rejected("example.com") {
+		t.Error("example.com is not rejected")
+	}
+
+	filename := filepath.Join(t.TempDir(), "state.json")
+	if err = r.SaveRules(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if n, err := r.ExpireRules(); err != nil || n != 1 {
+		t.Fatalf("ExpireRules() = %d, %v, expected 1 expired rule", n, err)
+	}
+	if rejected("example.com") {
+		t.Error("example.com is rejected after the expiration of its rule")
+	}
+
+	if ok, err := r.RemoveRule("example.org"); err != nil || !ok {
+		t.Fatalf("RemoveRule() = %v, %v, expected the rule removed", ok, err)
+	}
+	if rejected("example.org") {
+		t.Error("example.org is rejected after the removal of its rule")
+	}
+
+	// The expired rule is not reloaded
+	if n, err := r.LoadRules(filename); err != nil || n != 1 {
+		t.Fatalf("LoadRules() = %d, %v, expected 1 rule", n, err)
+	}
+	if !rejected("example.org") || rejected("example.com") {
+		t.Error("the loaded rules are not applied")
+	}
+}
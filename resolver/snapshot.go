@@ -0,0 +1,136 @@
+package resolver
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A snapshotEntry is a cached resolution written in a cache snapshot.
+type snapshotEntry struct {
+	Name    string        `json:"name"`
+	IP      net.IP        `json:"ip"`
+	IPs     []net.IP      `json:"ips"`
+	CNAMEs  []string      `json:"cnames,omitempty"`
+	TTL     time.Duration `json:"ttl"`
+	Expires time.Time     `json:"expires"`
+}
+
+// Save writes the cached resolutions to w.
+// The rejections, the unknown domain names and the domain names rewritten by $dnsrewrite rules are not saved.
+func (c *Cache) Save(w io.Writer) error {
+	entries := []snapshotEntry{}
+	c.names.Range(func(key, _ any) bool {
+		name := key.(string)
+
+		entry, ok := c.positive.Get(name)
+		if !ok {
+			c.names.Delete(name) // Evicted
+			return true
+		}
+		if slices.ContainsFunc(entry.result.Rules, isRewriteRule) {
+			return true
+		}
+
+		entries = append(entries, snapshotEntry{
+			Name:    name,
+			IP:      entry.result.IP,
+			IPs:     entry.result.IPs,
+			CNAMEs:  entry.result.CNAMEs,
+			TTL:     entry.ttl,
+			Expires: entry.expires,
+		})
+		return true
+	})
+
+	return json.NewEncoder(w).Encode(entries)
+}
+
+// Load reads the resolutions written by Save and caches them for their remaining TTL.
+// The resolutions are cached as returned by check, the expired ones and the ones check fails are skipped.
+// It returns the number of cached resolutions.
+func (c *Cache) Load(r io.Reader, check func(*Result) (*Result, error)) (int, error) {
+	var entries []snapshotEntry
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return 0, errors.Wrap(err, "could not decode cache snapshot")
+	}
+
+	var n int
+	now := time.Now()
+	for _, e := range entries {
+		if e.Name == "" || len(e.IPs) == 0 || !now.Before(e.Expires.Add(max(c.config.ServeStale, 0))) {
+			continue
+		}
+
+		result, err := check(&Result{Name: e.Name, IP: e.IP, IPs: e.IPs, CNAMEs: e.CNAMEs, TTL: time.Until(e.Expires), Cache: CacheMiss})
+		if err != nil {
+			continue
+		}
+
+		c.store(&cacheEntry{result: result, ttl: e.TTL, expires: e.Expires})
+		n++
+	}
+	return n, nil
+}
+
+// SaveCache writes the cached resolutions to the given file.
+// The file is replaced atomically so a crash cannot leave a partial snapshot.
+func (r *NameResolver) SaveCache(filename string) error {
+	return errors.Wrap(writeFile(filename, r.cache.Save), "could not write cache snapshot")
+}
+
+// LoadCache reads the cached resolutions from the given file written by SaveCache.
+// The resolutions are checked against the current policy, blocked networks and deny lists as they may have
+// changed since the snapshot, the names overridden by the hosts are skipped.
+// It returns the number of cached resolutions, a missing file is not an error.
+func (r *NameResolver) LoadCache(filename string) (int, error) {
+	f, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "could not read cache snapshot")
+	}
+	defer f.Close()
+
+	return r.cache.Load(f, func(result *Result) (*Result, error) {
+		if _, ok := r.hosts.Lookup(result.Name); ok {
+			return nil, errors.New("overridden by the hosts")
+		}
+		return r.filter.check(result)
+	})
+}
+
+// writeFile atomically replaces the given file by the content written by write.
+func writeFile(filename string, write func(io.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // No-op once renamed
+
+	if err = write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), filename)
+}
+
+func isRewriteRule(rule string) bool {
+	return strings.HasPrefix(rule, "dnsrewrite: ")
+}
@@ -0,0 +1,125 @@
+package resolver
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCacheSnapshot(t *testing.T) {
+	results := []*Result{
+		{Name: "a.test", IPs: []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}, TTL: time.Hour},
+		{Name: "alias.test", IPs: []net.IP{net.ParseIP("192.0.2.2")}, CNAMEs: []string{"cdn.test"}, TTL: time.Hour},
+		{Name: "short.test", IPs: []net.IP{net.ParseIP("192.0.2.3")}, TTL: 200 * time.Millisecond},
+		{Name: "rewritten.test", IPs: []net.IP{net.ParseIP("192.0.2.4")}, Rules: []string{"dnsrewrite: ||rewritten.test^$dnsrewrite=192.0.2.4"}, TTL: time.Hour},
+		{Name: "blocked.test", IPs: []net.IP{net.ParseIP("192.0.2.5")}, TTL: time.Hour},
+		{Name: "hosts.test", IPs: []net.IP{net.ParseIP("192.0.2.6")}, TTL: time.Hour},
+	}
+
+	tests := []struct {
+		name   string
+		config CacheConfig
+		wait   time.Duration
+		loaded []string
+		stale  []string
+	}{
+		{name: "fresh", loaded: []string{"a.test", "alias.test", "short.test"}},
+		{name: "expired", wait: 300 * time.Millisecond, loaded: []string{"a.test", "alias.test"}},
+		{
+			name:   "serve stale",
+			config: CacheConfig{ServeStale: time.Minute},
+			wait:   300 * time.Millisecond,
+			loaded: []string{"a.test", "alias.test", "short.test"},
+			stale:  []string{"short.test"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := New(Config{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, result := range results {
+				res := result.with(CacheMiss)
+				res.IP = preferIPv4(res.IPs)
+				r.cache.set(res)
+			}
+
+			filename := filepath.Join(t.TempDir(), "cache", "snapshot.json")
+			if err = r.SaveCache(filename); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(tt.wait)
+
+			// The snapshot is checked against the current configuration
+			config := Config{Cache: tt.config, DenyList: []string{"||blocked.test^"}}
+			if r, err = New(config); err != nil {
+				t.Fatal(err)
+			}
+			if err = r.OverrideHost("hosts.test", "192.0.2.60"); err != nil {
+				t.Fatal(err)
+			}
+
+			n, err := r.LoadCache(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(tt.loaded) {
+				t.Errorf("%d resolutions loaded, expected %d", n, len(tt.loaded))
+			}
+
+			for _, expected := range results {
+				entry, ok := r.cache.positive.Get(expected.Name)
+				if ok != slices.Contains(tt.loaded, expected.Name) {
+					t.Errorf("%s cached = %v, expected %v", expected.Name, ok, !ok)
+					continue
+				}
+				if !ok {
+					continue
+				}
+
+				// An expired resolution is served while it is resolved again
+				if stale := time.Now().After(entry.expires); stale != slices.Contains(tt.stale, expected.Name) {
+					t.Errorf("%s stale = %v, expected %v", expected.Name, stale, !stale)
+					continue
+				}
+				if slices.Contains(tt.stale, expected.Name) {
+					continue
+				}
+
+				result, err := r.Resolve(context.Background(), expected.Name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if result.Cache != CacheHit {
+					t.Errorf("%s cache = %s, expected %s", expected.Name, result.Cache, CacheHit)
+				}
+				if !slices.EqualFunc(result.IPs, expected.IPs, net.IP.Equal) || !result.IP.Equal(preferIPv4(expected.IPs)) {
+					t.Errorf("%s ips = %s %v, expected %v", expected.Name, result.IP, result.IPs, expected.IPs)
+				}
+				if !slices.Equal(result.CNAMEs, expected.CNAMEs) {
+					t.Errorf("%s cnames = %v, expected %v", expected.Name, result.CNAMEs, expected.CNAMEs)
+				}
+				if entry.ttl != expected.TTL {
+					t.Errorf("%s ttl = %s, expected %s", expected.Name, entry.ttl, expected.TTL)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadCacheMissing(t *testing.T) {
+	r, err := New(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := r.LoadCache(filepath.Join(t.TempDir(), "missing.json"))
+	if n != 0 || err != nil {
+		t.Errorf("LoadCache = %d, %v, expected 0, nil", n, err)
+	}
+}
@@ -0,0 +1,113 @@
+package resolver
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A RuleStats holds the hit counters of a rule.
+type RuleStats struct {
+	// Rule is the text of the rule, or the CIDR of a blocked network.
+	Rule string `json:"rule"`
+	// List is the name of the list of the rule.
+	List string `json:"list,omitempty"`
+	// Rejected is the number of rejected hosts.
+	Rejected int64 `json:"rejected"`
+	// Monitored is the number of hosts that would have been rejected without the monitor mode.
+	Monitored int64 `json:"monitored"`
+	// Allowed is the number of hosts allowed by the rule (e.g. exception or allowlist rule).
+	Allowed int64 `json:"allowed"`
+	// LastHit is the time of the last hit.
+	LastHit time.Time `json:"last_hit"`
+}
+
+// Stats counts the hits of the rules, the cached resolutions are counted at each hit.
+// It is safe for concurrent use.
+type Stats struct {
+	mu    sync.Mutex
+	rules map[string]*RuleStats
+}
+
+// NewStats returns a new Stats.
+func NewStats() *Stats {
+	return &Stats{rules: map[string]*RuleStats{}}
+}
+
+// Rules returns the counters of the rules that got a hit, sorted by decreasing number of hits.
+func (s *Stats) Rules() []RuleStats {
+	s.mu.Lock()
+	rules := make([]RuleStats, 0, len(s.rules))
+	for _, stats := range s.rules {
+		rules = append(rules, *stats)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(rules, func(i, j int) bool {
+		hi := rules[i].Rejected + rules[i].Monitored + rules[i].Allowed
+		hj := rules[j].Rejected + rules[j].Monitored + rules[j].Allowed
+		if hi != hj {
+			return hi > hj
+		}
+		return rules[i].Rule < rules[j].Rule
+	})
+	return rules
+}
+
+// Reset clears all the counters.
+func (s *Stats) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rules = map[string]*RuleStats{}
+}
+
+// record counts the rule of the rejection and returns the given error.
+func (s *Stats) record(err error) error {
+	var rejected *RejectedError
+	if !errors.As(err, &rejected) || rejected.Rule == "" {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := s.get(rejected.Rule, rejected.List)
+	if strings.HasPrefix(rejected.Kind, "monitor ") {
+		stats.Monitored++
+	} else {
+		stats.Rejected++
+	}
+	return err
+}
+
+// allowed counts the rules allowing a host (e.g. "denylist: @@||example.com^").
+func (s *Stats) allowed(rules []string) {
+	if len(rules) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, rule := range rules {
+		_, rule, _ = strings.Cut(rule, ": ")
+		s.get(rule, "").Allowed++
+	}
+}
+
+func (s *Stats) get(rule, list string) *RuleStats {
+	stats, ok := s.rules[rule]
+	if !ok {
+		stats = &RuleStats{Rule: rule}
+		s.rules[rule] = stats
+	}
+	if list != "" {
+		stats.List = list
+	}
+	stats.LastHit = time.Now()
+	return stats
+}
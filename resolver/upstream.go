@@ -0,0 +1,372 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// DefaultUpstreamTimeout is the maximum duration of a query to an upstream Domain Name Server.
+const DefaultUpstreamTimeout = 5 * time.Second
+
+// An Upstream is a Domain Name Server queried by the NameResolver.
+type Upstream interface {
+	// Exchange sends the query and returns the answer of the Domain Name Server.
+	Exchange(ctx context.Context, query *dns.Msg) (*dns.Msg, error)
+	// String returns the address of the Domain Name Server.
+	String() string
+}
+
+// An UpstreamConfig holds the settings of an Upstream.
+type UpstreamConfig struct {
+	// Address is the address of the Domain Name Server:
+	//  - 1.1.1.1, 1.1.1.1:53, udp://1.1.1.1:53 or tcp://1.1.1.1:53 for plain DNS
+	//  - tls://1.1.1.1:853 or tls://dns.google for DNS-over-TLS
+	//  - https://dns.google/dns-query for DNS-over-HTTPS
+	Address string
+	// Bootstrap is the list of IPs used to connect to an encrypted Domain Name Server given by its hostname.
+	// The hostname is resolved by the host resolver when empty.
+	Bootstrap []string
+	// CA is the PEM file of the certificate authorities verifying the encrypted Domain Name Server.
+	// The system pool is used when empty.
+	CA string
+	// Timeout is the maximum duration of a query (DefaultUpstreamTimeout by default).
+	Timeout time.Duration
+}
+
+type (
+	plainUpstream struct {
+		network string
+		address string
+		client  *dns.Client
+		tcp     *dns.Client
+	}
+
+	tlsUpstream struct {
+		address string
+		port    string
+		targets []string
+		client  *dns.Client
+	}
+
+	httpsUpstream struct {
+		url    string
+		client *http.Client
+	}
+)
+
+// NewUpstream returns a new Upstream for the given configuration.
+func NewUpstream(config UpstreamConfig) (Upstream, error) {
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultUpstreamTimeout
+	}
+
+	for _, ip := range config.Bootstrap {
+		if net.ParseIP(ip) == nil {
+			return nil, errors.Errorf("invalid bootstrap ip: %q", ip)
+		}
+	}
+
+	scheme, address, ok := strings.Cut(config.Address, "://")
+	if !ok {
+		scheme, address = "udp", config.Address
+	}
+
+	switch scheme {
+	case "udp", "tcp":
+		return &plainUpstream{
+			network: scheme,
+			address: withPort(address, "53"),
+			client:  &dns.Client{Net: scheme, Timeout: config.Timeout},
+			tcp:     &dns.Client{Net: "tcp", Timeout: config.Timeout},
+		}, nil
+	case "tls":
+		tlsconfig, err := newTLSConfig(config.CA)
+		if err != nil {
+			return nil, err
+		}
+
+		address = withPort(address, "853")
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid nameserver: %q", config.Address)
+		}
+		tlsconfig.ServerName = host
+
+		return &tlsUpstream{
+			address: config.Address,
+			port:    port,
+			targets: bootstrap(host, config.Bootstrap),
+			client:  &dns.Client{Net: "tcp-tls", Timeout: config.Timeout, TLSConfig: tlsconfig},
+		}, nil
+	case "https":
+		tlsconfig, err := newTLSConfig(config.CA)
+		if err != nil {
+			return nil, err
+		}
+
+		u, err := url.Parse(config.Address)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid nameserver: %q", config.Address)
+		}
+
+		dialer := &net.Dialer{Timeout: config.Timeout}
+		return &httpsUpstream{
+			url: u.String(),
+			client: &http.Client{
+				Timeout: config.Timeout,
+				Transport: &http.Transport{
+					// Never use a proxy from the environment, it could be this one.
+					Proxy:             nil,
+					TLSClientConfig:   tlsconfig,
+					ForceAttemptHTTP2: true,
+					IdleConnTimeout:   90 * time.Second,
+					DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+						host, port, err := net.SplitHostPort(address)
+						if err != nil {
+							return nil, err
+						}
+
+						var c net.Conn
+						for _, target := range bootstrap(host, config.Bootstrap) {
+							if c, err = dialer.DialContext(ctx, network, net.JoinHostPort(target, port)); err == nil {
+								return c, nil
+							}
+						}
+						return nil, err
+					},
+				},
+			},
+		}, nil
+	default:
+		return nil, errors.Errorf("unsupported nameserver scheme: %q", config.Address)
+	}
+}
+
+func (u *plainUpstream) Exchange(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	answer, _, err := u.client.ExchangeContext(ctx, query, u.address)
+	if err == nil && answer.Truncated && u.network == "udp" {
+		answer, _, err = u.tcp.ExchangeContext(ctx, query, u.address)
+	}
+	return answer, err
+}
+
+func (u *plainUpstream) String() string {
+	return u.network + "://" + u.address
+}
+
+func (u *tlsUpstream) Exchange(ctx context.Context, query *dns.Msg) (answer *dns.Msg, err error) {
+	for _, target := range u.targets {
+		if answer, _, err = u.client.ExchangeContext(ctx, query, net.JoinHostPort(target, u.port)); err == nil {
+			return answer, nil
+		}
+	}
+	return nil, err
+}
+
+func (u *tlsUpstream) String() string {
+	return u.address
+}
+
+// Exchange sends the query as described by RFC 8484.
+func (u *httpsUpstream) Exchange(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	// The ID is set to 0 to improve the HTTP caching.
+	q := query.Copy()
+	q.Id = 0
+
+	payload, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status %s", resp.Status)
+	}
+
+	payload, err = io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	answer := new(dns.Msg)
+	if err = answer.Unpack(payload); err != nil {
+		return nil, errors.Wrap(err, "invalid answer")
+	}
+	answer.Id = query.Id
+	return answer, nil
+}
+
+func (u *httpsUpstream) String() string {
+	return u.url
+}
+
+// lookupIP queries the A and AAAA records of the given name.
+// It returns the chain of canonical names (CNAME) of the answers and their lowest TTL,
+// or the negative TTL given by the SOA when no IP is found.
+func lookupIP(ctx context.Context, upstream Upstream, name string) ([]net.IP, []string, time.Duration, error) {
+	type result struct {
+		ips     []net.IP
+		aliases []*dns.CNAME
+		ttl     uint32
+		err     error
+	}
+
+	qtypes := []uint16{dns.TypeA, dns.TypeAAAA}
+	results := make(chan result, len(qtypes))
+	for _, qtype := range qtypes {
+		go func() {
+			query := new(dns.Msg)
+			query.SetQuestion(dns.Fqdn(name), qtype)
+
+			answer, err := upstream.Exchange(ctx, query)
+			if err != nil {
+				results <- result{err: errors.Wrap(err, upstream.String())}
+				return
+			}
+
+			switch answer.Rcode {
+			case dns.RcodeSuccess:
+			case dns.RcodeNameError:
+				results <- result{
+					ttl: negativeTTL(answer),
+					err: &net.DNSError{Err: "no such host", Name: name, Server: upstream.String(), IsNotFound: true},
+				}
+				return
+			default:
+				results <- result{err: errors.Errorf("%s: %s", upstream.String(), dns.RcodeToString[answer.Rcode])}
+				return
+			}
+
+			r := result{ttl: math.MaxUint32}
+			for _, rr := range answer.Answer {
+				switch rr := rr.(type) {
+				case *dns.A:
+					r.ips = append(r.ips, rr.A)
+				case *dns.AAAA:
+					r.ips = append(r.ips, rr.AAAA)
+				case *dns.CNAME:
+					r.aliases = append(r.aliases, rr)
+				default:
+					continue
+				}
+				r.ttl = min(r.ttl, rr.Header().Ttl)
+			}
+			if len(r.ips) == 0 {
+				r.ttl = negativeTTL(answer)
+			}
+			results <- r
+		}()
+	}
+
+	var ips []net.IP
+	var aliases []*dns.CNAME
+	var ttl, negative uint32 = math.MaxUint32, math.MaxUint32
+	var err error
+	for range qtypes {
+		r := <-results
+		if len(r.ips) > 0 {
+			ips = append(ips, r.ips...)
+			aliases = append(aliases, r.aliases...)
+			ttl = min(ttl, r.ttl)
+			continue
+		}
+
+		negative = min(negative, r.ttl)
+		if dnserr := new(net.DNSError); err == nil || errors.As(r.err, &dnserr) && dnserr.IsNotFound {
+			err = r.err
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil, nil, time.Duration(negative) * time.Second, err
+	}
+	return ips, cnames(name, aliases), time.Duration(ttl) * time.Second, nil
+}
+
+// cnames returns the chain of canonical names of the given name, in resolution order.
+func cnames(name string, aliases []*dns.CNAME) []string {
+	targets := map[string]string{}
+	for _, alias := range aliases {
+		targets[strings.ToLower(alias.Hdr.Name)] = strings.ToLower(alias.Target)
+	}
+
+	var chain []string
+	for owner := strings.ToLower(dns.Fqdn(name)); len(chain) < len(targets); {
+		target, ok := targets[owner]
+		if !ok {
+			break
+		}
+		chain = append(chain, strings.TrimSuffix(target, "."))
+		owner = target
+	}
+	return chain
+}
+
+// negativeTTL returns the duration an answer without record can be cached as described by RFC 2308.
+func negativeTTL(answer *dns.Msg) uint32 {
+	for _, rr := range answer.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return min(soa.Hdr.Ttl, soa.Minttl)
+		}
+	}
+	return 0
+}
+
+// newTLSConfig returns a TLS configuration verifying the certificates with the given CA file.
+func newTLSConfig(ca string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if ca == "" {
+		return config, nil
+	}
+
+	payload, err := os.ReadFile(ca)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read nameserver CA")
+	}
+
+	config.RootCAs = x509.NewCertPool()
+	if !config.RootCAs.AppendCertsFromPEM(payload) {
+		return nil, errors.Errorf("no certificate found in %s", ca)
+	}
+	return config, nil
+}
+
+// bootstrap returns the addresses to connect to for the given host.
+func bootstrap(host string, ips []string) []string {
+	if len(ips) == 0 || net.ParseIP(host) != nil {
+		return []string{host}
+	}
+	return ips
+}
+
+func withPort(address, port string) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+	return net.JoinHostPort(strings.Trim(address, "[]"), port)
+}
@@ -0,0 +1,223 @@
+package resolver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// stubHandler answers example.test with an A record and any other name with NXDOMAIN and a SOA
+// whose negative TTL is 60s.
+var stubHandler = dns.HandlerFunc(func(w dns.ResponseWriter, query *dns.Msg) {
+	w.WriteMsg(stubAnswer(query))
+})
+
+func stubAnswer(query *dns.Msg) *dns.Msg {
+	answer := new(dns.Msg)
+	answer.SetReply(query)
+
+	q := query.Question[0]
+	if q.Name != "example.test." {
+		answer.Rcode = dns.RcodeNameError
+		answer.Ns = []dns.RR{&dns.SOA{
+			Hdr:     dns.RR_Header{Name: "test.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 600},
+			Ns:      "ns.test.",
+			Mbox:    "admin.test.",
+			Serial:  1,
+			Minttl:  60,
+			Expire:  3600,
+			Refresh: 3600,
+			Retry:   600,
+		}}
+		return answer
+	}
+
+	if q.Qtype == dns.TypeA {
+		answer.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(192, 0, 2, 1),
+		}}
+	}
+	return answer
+}
+
+// stubCertificate returns a self-signed certificate of dns.test and the file of its PEM.
+func stubCertificate(t *testing.T) (tls.Certificate, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dns.test"},
+		DNSNames:              []string{"dns.test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filename := filepath.Join(t.TempDir(), "ca.pem")
+	if err = os.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, filename
+}
+
+// startTLSStub starts a DNS-over-TLS stub and returns its port.
+func startTLSStub(t *testing.T, cert tls.Certificate) string {
+	t.Helper()
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &dns.Server{Listener: l, Net: "tcp-tls", Handler: stubHandler}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return port
+}
+
+// startHTTPSStub starts a DNS-over-HTTPS stub and returns its port.
+func startHTTPSStub(t *testing.T, cert tls.Certificate) string {
+	t.Helper()
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		query := new(dns.Msg)
+		if err = query.Unpack(payload); err != nil || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "invalid query", http.StatusBadRequest)
+			return
+		}
+
+		payload, _ = stubAnswer(query).Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(payload)
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0) // The rejected certificates are expected
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	return port
+}
+
+func TestEncryptedUpstreams(t *testing.T) {
+	cert, ca := stubCertificate(t)
+	tlsPort := startTLSStub(t, cert)
+	httpsPort := startHTTPSStub(t, cert)
+
+	addresses := map[string]string{
+		"tls":   "tls://dns.test:" + tlsPort,
+		"https": "https://dns.test:" + httpsPort + "/dns-query",
+	}
+
+	for scheme, address := range addresses {
+		t.Run(scheme, func(t *testing.T) {
+			ctx := context.Background()
+
+			// dns.test does not resolve, it is only reachable through its bootstrap IPs.
+			// 127.0.0.2 refuses the connections so the next bootstrap IP is dialed.
+			upstream, err := NewUpstream(UpstreamConfig{
+				Address:   address,
+				Bootstrap: []string{"127.0.0.2", "127.0.0.1"},
+				CA:        ca,
+				Timeout:   2 * time.Second,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ips, _, ttl, err := lookupIP(ctx, upstream, "example.test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 1)) || ttl != 300*time.Second {
+				t.Errorf("lookupIP(example.test) = %v, %s, expected [192.0.2.1], 5m0s", ips, ttl)
+			}
+
+			// The negative TTL is the lowest of the TTL and the minimum TTL of the SOA
+			_, _, ttl, err = lookupIP(ctx, upstream, "missing.test")
+			var dnserr *net.DNSError
+			if !errors.As(err, &dnserr) || !dnserr.IsNotFound {
+				t.Errorf("lookupIP(missing.test) = %v, expected no such host", err)
+			}
+			if ttl != 60*time.Second {
+				t.Errorf("negative TTL = %s, expected 1m0s", ttl)
+			}
+		})
+
+		t.Run(scheme+" unknown authority", func(t *testing.T) {
+			// Verified with the system pool
+			upstream, err := NewUpstream(UpstreamConfig{
+				Address:   address,
+				Bootstrap: []string{"127.0.0.1"},
+				Timeout:   2 * time.Second,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, _, _, err = lookupIP(context.Background(), upstream, "example.test")
+			var verr *tls.CertificateVerificationError
+			if !errors.As(err, &verr) {
+				t.Errorf("lookupIP() = %v, expected a certificate verification error", err)
+			}
+		})
+	}
+
+	t.Run("hostname mismatch", func(t *testing.T) {
+		upstream, err := NewUpstream(UpstreamConfig{
+			Address:   "tls://other.test:" + tlsPort,
+			Bootstrap: []string{"127.0.0.1"},
+			CA:        ca,
+			Timeout:   2 * time.Second,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, _, _, err = lookupIP(context.Background(), upstream, "example.test")
+		var verr *tls.CertificateVerificationError
+		if !errors.As(err, &verr) {
+			t.Errorf("lookupIP() = %v, expected a certificate verification error", err)
+		}
+	})
+}
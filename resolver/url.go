@@ -0,0 +1,84 @@
+package resolver
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/AdguardTeam/urlfilter/rules"
+)
+
+// A URLRequest holds the details of an HTTP request checked against the deny list.
+type URLRequest struct {
+	Method   string
+	URL      string
+	Referrer string
+	Type     rules.RequestType
+}
+
+// NewURLRequest returns a new URLRequest where the request type is guessed from the given header.
+// The URL is normalized: host normalized (see NormalizeHost), default port removed and unreserved characters
+// of the path decoded.
+func NewURLRequest(method, url string, header http.Header) URLRequest {
+	return URLRequest{
+		Method:   method,
+		URL:      normalizeURL(url),
+		Referrer: header.Get("Referer"),
+		Type:     requestType(header),
+	}
+}
+
+// FilterURL checks the full URL of the request against the deny list.
+// The URL is normalized first so the rules cannot be bypassed by an equivalent URL (see NewURLRequest).
+// The rejections of the lists in monitor mode are reported (see OnMonitor) and the request is allowed.
+func (r *NameResolver) FilterURL(_ context.Context, req URLRequest) error {
+	typ := req.Type
+	if typ == 0 {
+		typ = rules.TypeOther
+	}
+
+	req.URL = normalizeURL(req.URL)
+
+	filters := r.current()
+	rule, ok := filters.urls.Match(rules.NewRequest(req.URL, req.Referrer, typ))
+	if !ok || rule.Whitelist {
+		return nil
+	}
+
+	var monitored []*RejectedError
+	err := filters.reject(ruleMatch{rule: rule.String(), list: rule.GetFilterListID()}, "url", req.Method+" "+req.URL, &monitored)
+	r.report(monitored)
+	return r.stats.record(err)
+}
+
+// fetchDestinations maps Sec-Fetch-Dest header values to the corresponding request types.
+var fetchDestinations = map[string]rules.RequestType{
+	"audio":         rules.TypeMedia,
+	"audioworklet":  rules.TypeScript,
+	"document":      rules.TypeDocument,
+	"empty":         rules.TypeXmlhttprequest,
+	"font":          rules.TypeFont,
+	"frame":         rules.TypeSubdocument,
+	"iframe":        rules.TypeSubdocument,
+	"image":         rules.TypeImage,
+	"object":        rules.TypeObject,
+	"paintworklet":  rules.TypeScript,
+	"script":        rules.TypeScript,
+	"serviceworker": rules.TypeScript,
+	"sharedworker":  rules.TypeScript,
+	"style":         rules.TypeStylesheet,
+	"video":         rules.TypeMedia,
+	"worker":        rules.TypeScript,
+}
+
+func requestType(header http.Header) rules.RequestType {
+	if header.Get("Upgrade") == "websocket" {
+		return rules.TypeWebsocket
+	}
+	if header.Get("Ping-To") != "" {
+		return rules.TypePing
+	}
+	if typ, ok := fetchDestinations[header.Get("Sec-Fetch-Dest")]; ok {
+		return typ
+	}
+	return rules.TypeOther
+}
@@ -0,0 +1,67 @@
+package resolver
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestNormalizeURL(t *testing.T) {
+	tests := []struct {
+		url      string
+		expected string
+	}{
+		{"http://example.com/ads/x", "http://example.com/ads/x"},
+		{"http://EXAMPLE.com./ads/x", "http://example.com/ads/x"},
+		{"http://example.com:80/ads/x", "http://example.com/ads/x"},
+		{"https://example.com:443/ads/x", "https://example.com/ads/x"},
+		{"http://example.com:443/ads/x", "http://example.com:443/ads/x"},
+		{"https://example.com:80/ads/x", "https://example.com:80/ads/x"},
+		{"http://example.com:8080/ads/x", "http://example.com:8080/ads/x"},
+		{"http://[0:0::1]:80/ads/x", "http://[::1]/ads/x"},
+		{"http://example.com/%61ds/x", "http://example.com/ads/x"},
+		{"http://example.com/%61%64%73/%78", "http://example.com/ads/x"},
+		{"http://example.com/%7Euser/%2D%2e%5F", "http://example.com/~user/-._"},
+		{"http://example.com/ads%2Fx", "http://example.com/ads%2Fx"},
+		{"http://example.com/a%20b", "http://example.com/a%20b"},
+		{"http://example.com/%61ds/x?q=%61", "http://example.com/ads/x?q=%61"},
+		{"http://example.com/%6", "http://example.com/%6"},
+	}
+
+	for _, test := range tests {
+		if actual := normalizeURL(test.url); actual != test.expected {
+			t.Errorf("normalizeURL(%q) = %q, expected %q", test.url, actual, test.expected)
+		}
+	}
+}
+
+func TestFilterURL(t *testing.T) {
+	r, err := New(Config{DenyList: []string{"||example.com/ads/"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url      string
+		rejected bool
+	}{
+		{"http://example.com/ads/x", true},
+		{"http://example.com:80/ads/x", true},
+		{"https://example.com:443/ads/x", true},
+		{"http://example.com/%61ds/x", true},
+		{"http://example.com/%61%64%73/x", true},
+		{"http://EXAMPLE.COM:80/%61ds/x", true},
+		{"http://example.com/content/x", false},
+		{"http://example.com/ads%2Fx", false},
+	}
+
+	for _, test := range tests {
+		// Without NewURLRequest, FilterURL normalizes the URL itself
+		for _, req := range []URLRequest{{Method: "GET", URL: test.url}, NewURLRequest("GET", test.url, nil)} {
+			err := r.FilterURL(context.Background(), req)
+			if rejected := errors.Is(err, ErrHostRejected); rejected != test.rejected {
+				t.Errorf("FilterURL(%q) = %v, expected rejected: %v", req.URL, err, test.rejected)
+			}
+		}
+	}
+}
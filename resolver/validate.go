@@ -0,0 +1,51 @@
+package resolver
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+
+	"github.com/AdguardTeam/urlfilter/rules"
+)
+
+// A RuleError is an invalid rule of a list.
+type RuleError struct {
+	Source string
+	Line   int
+	Rule   string
+	Err    error
+}
+
+func (e *RuleError) Error() string {
+	return fmt.Sprintf("%s:%d: invalid rule %q: %v", e.Source, e.Line, e.Rule, e.Err)
+}
+
+func (e *RuleError) Unwrap() error {
+	return e.Err
+}
+
+// ValidateRule returns an error when the given rule cannot be parsed by urlfilter.
+func ValidateRule(rule string) error {
+	_, err := rules.NewRule(rule, InlineListID)
+	return err
+}
+
+// ValidateRules returns the invalid rules of the given list.
+func ValidateRules(source string, text []byte) []*RuleError {
+	var errs []*RuleError
+
+	scanner := bufio.NewScanner(bytes.NewReader(text))
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if err := ValidateRule(scanner.Text()); err != nil {
+			errs = append(errs, &RuleError{
+				Source: source,
+				Line:   line,
+				Rule:   scanner.Text(),
+				Err:    err,
+			})
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	nethttp "net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrResolverOverridden is returned by the admin API when the Resolver hook is not the resolver built by New,
+// the rules and the cache it manages would not apply to the resolutions.
+var ErrResolverOverridden = errors.New("ergo: admin API unavailable with an overridden Resolver")
+
+// A ruleRequest is the body of a POST /rules request.
+type ruleRequest struct {
+	Rule string `json:"rule"`
+	// TTL is the duration before the rule expires (e.g. 1h), it never expires when empty.
+	TTL string `json:"ttl"`
+}
+
+// AdminHandler returns the handler of the admin API:
+//   - GET /rules returns the deny rules added at runtime
+//   - POST /rules adds a deny rule, e.g. {"rule": "||example.com^", "ttl": "1h"}
+//   - DELETE /rules?rule=||example.com^ removes a deny rule added at runtime
+//   - GET /rules/stats returns the hit counters of the rules
+//   - DELETE /rules/stats resets the hit counters of the rules
+//   - POST /cache/flush clears the name resolutions cache
+//
+// All the requests fail with ErrResolverOverridden when the Resolver hook has been replaced.
+func (s *Server) AdminHandler() nethttp.Handler {
+	if err := s.checkAdmin(); err != nil {
+		return nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+			writeError(w, nethttp.StatusNotImplemented, err)
+		})
+	}
+
+	mux := nethttp.NewServeMux()
+	mux.HandleFunc("GET /rules", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		writeJSON(w, nethttp.StatusOK, s.names.RuntimeRules())
+	})
+	mux.HandleFunc("POST /rules", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		var req ruleRequest
+		if err := json.NewDecoder(nethttp.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			writeError(w, nethttp.StatusBadRequest, errors.Wrap(err, "invalid body"))
+			return
+		}
+
+		var ttl time.Duration
+		if req.TTL != "" {
+			var err error
+			ttl, err = time.ParseDuration(req.TTL)
+			if err != nil || ttl <= 0 {
+				writeError(w, nethttp.StatusBadRequest, errors.Errorf("invalid ttl %q", req.TTL))
+				return
+			}
+		}
+
+		rule, err := s.names.AddRule(req.Rule, ttl)
+		if err != nil {
+			writeError(w, nethttp.StatusBadRequest, err)
+			return
+		}
+
+		s.saveRules()
+		writeJSON(w, nethttp.StatusCreated, rule)
+	})
+	mux.HandleFunc("DELETE /rules", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		rule := r.URL.Query().Get("rule")
+		found, err := s.names.RemoveRule(rule)
+		if err != nil {
+			writeError(w, nethttp.StatusInternalServerError, err)
+			return
+		}
+		if !found {
+			writeError(w, nethttp.StatusNotFound, errors.Errorf("rule %q not found", rule))
+			return
+		}
+
+		s.saveRules()
+		w.WriteHeader(nethttp.StatusNoContent)
+	})
+	mux.HandleFunc("POST /cache/flush", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		s.names.FlushCache()
+		w.WriteHeader(nethttp.StatusNoContent)
+	})
+	mux.HandleFunc("GET /rules/stats", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		writeJSON(w, nethttp.StatusOK, s.names.Stats().Rules())
+	})
+	mux.HandleFunc("DELETE /rules/stats", func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		s.names.Stats().Reset()
+		w.WriteHeader(nethttp.StatusNoContent)
+	})
+
+	if s.config.AdminAuthorization == "" {
+		return mux
+	}
+
+	return nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		user, password, _ := r.BasicAuth()
+		if subtle.ConstantTimeCompare([]byte(user+":"+password), []byte(s.config.AdminAuthorization)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="ergo admin"`)
+			writeError(w, nethttp.StatusUnauthorized, errors.New("invalid authorization"))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// ServeAdmin accepts incoming connections on the listener l and serves the admin API.
+// ServeAdmin always closes l and returns a non-nil error, ErrResolverOverridden when the Resolver hook has been replaced.
+func (s *Server) ServeAdmin(l net.Listener) error {
+	if err := s.checkAdmin(); err != nil {
+		l.Close()
+		return err
+	}
+
+	srv := &nethttp.Server{
+		Handler:           s.AdminHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	if !s.trackAdmin(srv) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.untrackAdmin(srv)
+
+	err := srv.Serve(l)
+	if errors.Is(err, nethttp.ErrServerClosed) {
+		return ErrServerClosed
+	}
+	return errors.Wrap(err, "could not serve admin API")
+}
+
+func (s *Server) trackAdmin(srv *nethttp.Server) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	s.admins[srv] = struct{}{}
+	return true
+}
+
+func (s *Server) untrackAdmin(srv *nethttp.Server) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.admins, srv)
+}
+
+func writeJSON(w nethttp.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// checkAdmin returns an error when the admin API cannot manage the Resolver.
+func (s *Server) checkAdmin() error {
+	if s.Resolver != Resolver(s.names) {
+		return ErrResolverOverridden
+	}
+	return nil
+}
+
+func writeError(w nethttp.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"errors"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mdouchement/ergo/resolver"
+)
+
+func TestAdminResolver(t *testing.T) {
+	srv, err := New(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	srv.AdminHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/rules", nil))
+	if rec.Code != nethttp.StatusOK {
+		t.Errorf("got status %d, expected %d", rec.Code, nethttp.StatusOK)
+	}
+
+	srv.Resolver = resolver.Chain(resolver.NewHostResolver(), resolver.Normalize)
+
+	rec = httptest.NewRecorder()
+	srv.AdminHandler().ServeHTTP(rec, httptest.NewRequest("POST", "/cache/flush", nil))
+	if rec.Code != nethttp.StatusNotImplemented {
+		t.Errorf("got status %d with an overridden resolver, expected %d", rec.Code, nethttp.StatusNotImplemented)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = srv.ServeAdmin(l); !errors.Is(err, ErrResolverOverridden) {
+		t.Errorf("got %v, expected %v", err, ErrResolverOverridden)
+	}
+	if _, err = net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Error("listener not closed")
+	}
+}
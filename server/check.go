@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	nethttp "net/http"
+	"net/url"
+
+	"github.com/mdouchement/ergo/resolver"
+)
+
+// A Request holds the details of a proxy request.
+type Request struct {
+	// User is the authenticated user, empty when the authentication is disabled.
+	User   string
+	Method string
+	Host   string
+	Port   string
+	// URL is the absolute URL of a plain HTTP request, empty for CONNECT requests.
+	URL    string
+	Header nethttp.Header
+}
+
+// Check checks the request against the restrictions and the policy and returns the resolution of the host.
+// The host is normalized (see resolver.NormalizeHost) before any check.
+// A request whose URL is not on the host and port of the request is rejected as misdirected.
+func (s *Server) Check(ctx context.Context, req Request) (*resolver.Result, error) {
+	host, err := resolver.NormalizeHost(req.Host)
+	if err != nil {
+		return nil, err
+	}
+	req.Host = host
+
+	if err := s.restrictionsOf(req.User).check(req.Method, req.Host, req.Port); err != nil {
+		return nil, err
+	}
+
+	// The remote is the one of the Host header, the URL must not give another host to the URL filter
+	if req.URL != "" && !sameURLAddress(req.URL, req.Host, req.Port) {
+		return nil, &resolver.RejectedError{Kind: "misdirected", Target: req.Method + " " + req.URL}
+	}
+
+	result, err := s.Resolver.Resolve(ctx, req.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.URL != "" {
+		err = s.filterURL(ctx, resolver.NewURLRequest(req.Method, req.URL, req.Header))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// sameURLAddress returns true when the host and the port of the absolute URL are the given ones,
+// the port being the default one of the scheme when omitted.
+func sameURLAddress(rawURL, host, port string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+
+	uport := u.Port()
+	if uport == "" {
+		uport = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+
+	uhost, err := resolver.NormalizeHost(u.Hostname())
+	return err == nil && uhost == host && uport == port
+}
+
+// restrictionsOf returns the restrictions of the given user.
+func (s *Server) restrictionsOf(user string) *restrictions {
+	if r, ok := s.users[user]; ok && user != "" {
+		return r
+	}
+	return s.restrictions
+}
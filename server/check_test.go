@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mdouchement/ergo/resolver"
+)
+
+func TestCheckURL(t *testing.T) {
+	srv, err := New(Config{
+		Config: resolver.Config{DenyList: []string{"||tracker.test/ads/*"}},
+		Hosts:  map[string]IPs{"allowed.test": {"192.0.2.1"}, "tracker.test": {"192.0.2.2"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host    string
+		port    string
+		url     string
+		allowed bool
+		kind    string
+	}{
+		{host: "allowed.test", port: "80", url: "http://allowed.test/ads/x", allowed: true},
+		{host: "allowed.test", port: "80", url: "http://ALLOWED.test:80/ads/x", allowed: true},
+		{host: "allowed.test", port: "8080", url: "http://allowed.test:8080/", allowed: true},
+		{host: "tracker.test", port: "80", url: "http://tracker.test/", allowed: true},
+		{host: "tracker.test", port: "80", url: "http://tracker.test/ads/x", kind: "url"},
+		// The URL filter must check the dialed host
+		{host: "tracker.test", port: "80", url: "http://allowed.test/ads/x", kind: "misdirected"},
+		{host: "allowed.test", port: "80", url: "http://allowed.test:8080/", kind: "misdirected"},
+		{host: "allowed.test", port: "8080", url: "http://allowed.test/", kind: "misdirected"},
+	}
+
+	for _, test := range tests {
+		_, err := srv.Check(context.Background(), Request{Method: "GET", Host: test.host, Port: test.port, URL: test.url})
+		if test.allowed {
+			if err != nil {
+				t.Errorf("%s on %s:%s: %v", test.url, test.host, test.port, err)
+			}
+			continue
+		}
+
+		var rejected *resolver.RejectedError
+		if !errors.As(err, &rejected) || rejected.Kind != test.kind {
+			t.Errorf("%s on %s:%s: got %v, expected a %s rejection", test.url, test.host, test.port, err, test.kind)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mdouchement/ergo/resolver"
+	"github.com/mdouchement/logger"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// ShutdownTimeout is the duration given to the active connections to be relayed on shutdown.
+const ShutdownTimeout = 10 * time.Second
+
+// Command is used to launch Ergo proxy server.
+func Command() *cobra.Command {
+	var cfg string
+
+	c := &cobra.Command{
+		Use:   "server",
+		Short: "Starts the Ergo proxy server",
+		Args:  cobra.ExactArgs(0),
+		RunE: func(_ *cobra.Command, _ []string) error {
+			cfg = ConfigFile(cfg)
+
+			lopts := &logger.SlogTextOption{
+				DisableColors:   false,
+				ForceColors:     true,
+				ForceFormatting: true,
+				PrefixRE:        regexp.MustCompile(`^(\[.*?\])\s`),
+				FullTimestamp:   true,
+				TimestampFormat: "2006-01-02 15:04:05",
+			}
+			log := logger.WrapSlogHandler(logger.NewSlogTextHandler(os.Stdout, lopts))
+
+			//
+
+			var config Config
+			{
+
+				if cfg == "" {
+					log.Info("Reading configuration from environment")
+				} else {
+					log.Infof("Reading configuration from %s", cfg)
+				}
+				var err error
+				config, err = LoadConfig(cfg, false)
+				if err != nil {
+					return err
+				}
+
+				if config.Logger != "" {
+					lopts.Level, err = logger.ParseSlogLevel(config.Logger)
+					if err != nil {
+						return errors.Wrapf(err, "could not parse logger level %s", cfg)
+					}
+
+					log = logger.WrapSlogHandler(logger.NewSlogTextHandler(os.Stdout, lopts))
+				}
+			}
+
+			srv, err := New(config)
+			if err != nil {
+				return errors.Wrapf(err, "could not build server %s", cfg)
+			}
+			srv.Logger = log
+
+			//
+			//
+			//
+
+			if config.Authorization != "" {
+				log.Info("Authorization enabled")
+			} else {
+				log.Info("Authorization disabled")
+			}
+
+			if config.NameServer != "" {
+				log.Info("Name server forced to ", config.NameServer)
+			}
+			if len(config.NameServers) > 0 {
+				log.Info("Name servers: ", strings.Join(config.NameServers, ", "))
+			}
+			if config.NameServer == "" && len(config.NameServers) == 0 {
+				if nameservers, err := resolver.SystemNameServers(); err == nil {
+					log.Info("Name servers of ", resolver.ResolvConf, ": ", strings.Join(nameservers, ", "))
+				} else {
+					log.Warnf("Falling back to the host resolver (%s): the resolutions are cached for %s regardless of their DNS TTL and their CNAME chains are not checked", err, resolver.HostResolverTTL)
+				}
+			}
+
+			stopped := make(chan struct{})
+			go func() {
+				defer close(stopped)
+
+				signals := make(chan os.Signal, 1)
+				signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+				<-signals
+
+				log.Info("Shutting down")
+				ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+				defer cancel()
+
+				if err := srv.Shutdown(ctx); err != nil {
+					log.WithError(err).Error("could not gracefully shutdown")
+				}
+			}()
+
+			err = srv.ListenAndServe()
+			if errors.Is(err, ErrServerClosed) {
+				<-stopped
+				return nil
+			}
+			return err
+		},
+	}
+	c.Flags().StringVarP(&cfg, "config", "c", os.Getenv("ERGO_PROXY_CONFIG"), "Server's configuration")
+
+	return c
+}
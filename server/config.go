@@ -0,0 +1,219 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/mdouchement/ergo/mitm"
+	"github.com/mdouchement/ergo/resolver"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// A Config holds the settings of an Ergo proxy server.
+type Config struct {
+	// Config holds the settings of the name resolver.
+	resolver.Config `yaml:",inline"`
+
+	// Address is the address to listen to.
+	Address string `yaml:"addr"`
+	// Restrictions holds the destination ports and methods allowed to the clients.
+	Restrictions Restrictions `yaml:"restrictions"`
+	// TransparentAddress is the address to listen to for connections redirected by netfilter
+	// (e.g. iptables REDIRECT rule). An empty value disables the transparent mode (Linux only).
+	TransparentAddress string `yaml:"transparent_addr"`
+	// Authorization is the `user:password` credentials used to authenticate requests.
+	// An empty value disables the authentication.
+	Authorization string `yaml:"authorization"`
+	// AdminAddress is the address to listen to for the admin API. An empty value disables the admin API.
+	AdminAddress string `yaml:"admin_addr"`
+	// AdminAuthorization is the `user:password` credentials used to authenticate the admin API requests.
+	// An empty value disables the authentication.
+	AdminAuthorization string `yaml:"admin_authorization"`
+	// AdminStatePath is the file where the deny rules added by the admin API are saved to be reloaded on restart.
+	// Disabled when empty.
+	AdminStatePath string `yaml:"admin_state_path"`
+	// Logger is the logger level.
+	Logger string `yaml:"logger"`
+	// SNIInspection is the inspection mode of the TLS server name sent in CONNECT tunnels.
+	// An empty value disables the inspection.
+	SNIInspection string `yaml:"sni_inspection"`
+	// MITM enables the TLS interception of the CONNECT tunnels when set.
+	MITM *mitm.Config `yaml:"mitm"`
+	// Hosts is the list of static IPs of domain names, a domain name starting with "*." matches all its subdomains.
+	Hosts map[string]IPs `yaml:"hosts"`
+	// HostsFiles is the list of files using the /etc/hosts format loaded in addition of Hosts.
+	HostsFiles []string `yaml:"hosts_files"`
+	// CachePath is the file where the name resolutions are saved to be reloaded on restart. Disabled when empty.
+	CachePath string `yaml:"cache_path"`
+	// CacheSaveInterval is the interval between two saves of CachePath (default 5m), it is also saved on shutdown.
+	CacheSaveInterval time.Duration `yaml:"cache_save_interval"`
+	// DenyLists is the list of files, directories and HTTP(S) URLs of deny lists loaded in addition of DenyList.
+	DenyLists []string `yaml:"denylists"`
+	// DenyListsCache is the directory where the remote deny lists are kept as a fallback.
+	DenyListsCache string `yaml:"denylists_cache"`
+	// DenyListsRefresh is the interval between two refreshes of DenyLists (default 24h).
+	DenyListsRefresh time.Duration `yaml:"denylists_refresh"`
+	// DenyListsMonitor is the list of the sources of DenyLists in monitor mode.
+	DenyListsMonitor []string `yaml:"denylists_monitor"`
+}
+
+// IPs is a list of IPs written as a single IP or as a list.
+type IPs []string
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (ips *IPs) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*ips = IPs{node.Value}
+		return nil
+	}
+
+	var list []string
+	if err := node.Decode(&list); err != nil {
+		return err
+	}
+	*ips = list
+	return nil
+}
+
+// DefaultConfigFile is the configuration file loaded when none is given and it exists.
+const DefaultConfigFile = "ergo.yml"
+
+// ConfigFile returns the configuration file to load: the given one, DefaultConfigFile when it exists
+// or an empty filename to load the configuration from the environment only.
+func ConfigFile(filename string) string {
+	if filename != "" {
+		return filename
+	}
+	if _, err := os.Stat(DefaultConfigFile); err == nil {
+		return DefaultConfigFile
+	}
+	return ""
+}
+
+// LoadConfig reads the configuration from the given YAML file and the environment.
+// The ${VAR} of the values are replaced by the environment variables, the keys suffixed by _file
+// are read from the given files and the ERGO_* environment variables override the file settings.
+// An empty filename loads the configuration from the environment only.
+// Unknown keys are reported as errors in strict mode.
+func LoadConfig(filename string, strict bool) (Config, error) {
+	var config Config
+
+	if filename != "" {
+		payload, err := os.ReadFile(filename)
+		if err != nil {
+			return config, errors.Wrapf(err, "could not read configuration file %s", filename)
+		}
+
+		var root yaml.Node
+		if err = yaml.Unmarshal(payload, &root); err != nil {
+			return config, errors.Wrapf(err, "could not parse configuration file %s", filename)
+		}
+
+		if err = interpolate(&root); err != nil {
+			return config, errors.Wrapf(err, "could not interpolate configuration file %s", filename)
+		}
+
+		if len(root.Content) > 0 {
+			// Encoded back to benefit from the strict mode of the decoder.
+			payload, err = yaml.Marshal(&root)
+			if err != nil {
+				return config, errors.Wrapf(err, "could not interpolate configuration file %s", filename)
+			}
+
+			decoder := yaml.NewDecoder(bytes.NewReader(payload))
+			decoder.KnownFields(strict)
+
+			err = decoder.Decode(&config)
+			if err != nil && !errors.Is(err, io.EOF) {
+				return config, errors.Wrapf(err, "could not parse configuration file %s", filename)
+			}
+		}
+	}
+
+	if _, err := applyEnv(reflect.ValueOf(&config).Elem(), EnvPrefix); err != nil {
+		return config, errors.Wrap(err, "could not read configuration from environment")
+	}
+
+	return config, nil
+}
+
+// ruleKeys are the keys of the urlfilter rule lists of the configuration.
+var ruleKeys = [][]string{{"denylist"}, {"allowlist"}, {"mitm", "domains"}, {"mitm", "bypass"}}
+
+// ValidateRules returns the invalid urlfilter rules of the configuration loaded by LoadConfig from the given file
+// and the environment. The rules are validated once interpolated, the ones of the file are reported with their
+// line in the file and the ones overridden by the environment with their line in the variable (or its _file).
+func ValidateRules(filename string) ([]*resolver.RuleError, error) {
+	var document *yaml.Node
+	if filename != "" {
+		payload, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not read configuration file %s", filename)
+		}
+
+		var root yaml.Node
+		if err = yaml.Unmarshal(payload, &root); err != nil {
+			return nil, errors.Wrapf(err, "could not parse configuration file %s", filename)
+		}
+
+		if err = interpolate(&root); err != nil {
+			return nil, errors.Wrapf(err, "could not interpolate configuration file %s", filename)
+		}
+
+		if len(root.Content) > 0 {
+			document = root.Content[0]
+		}
+	}
+
+	var errs []*resolver.RuleError
+	for _, key := range ruleKeys {
+		value, source, ok, err := lookupEnv(EnvPrefix + "_" + strings.ToUpper(strings.Join(key, "_")))
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read configuration from environment")
+		}
+		if ok {
+			errs = append(errs, resolver.ValidateRules(source, []byte(value))...)
+			continue
+		}
+
+		node := document
+		for _, k := range key {
+			node = lookup(node, k)
+		}
+		if node == nil || node.Kind != yaml.SequenceNode {
+			continue
+		}
+
+		for _, item := range node.Content {
+			if err := resolver.ValidateRule(item.Value); err != nil {
+				errs = append(errs, &resolver.RuleError{
+					Source: filename,
+					Line:   item.Line,
+					Rule:   item.Value,
+					Err:    err,
+				})
+			}
+		}
+	}
+
+	return errs, nil
+}
+
+// lookup returns the value of the given key of the mapping node.
+func lookup(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix is the prefix of the environment variables overriding the configuration.
+// e.g. ERGO_ADDR overrides addr and ERGO_MITM_CA_CERT overrides mitm.ca_cert.
+const EnvPrefix = "ERGO"
+
+// FileSuffix is the suffix of the keys and environment variables whose value is read from a file.
+// e.g. authorization_file or ERGO_AUTHORIZATION_FILE.
+const FileSuffix = "_file"
+
+var interpolation = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// interpolate replaces the ${VAR} and ${VAR:-default} of the scalar values by the environment variables
+// and the values of the keys suffixed by _file by the content of the files.
+func interpolate(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		value := interpolation.ReplaceAllStringFunc(node.Value, func(s string) string {
+			m := interpolation.FindStringSubmatch(s)
+			if v, ok := os.LookupEnv(m[1]); ok {
+				return v
+			}
+			return m[3]
+		})
+		if value != node.Value && node.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle) == 0 {
+			node.Tag = "" // Resolved again from the interpolated value (e.g. bool, duration)
+		}
+		node.Value = value
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if err := interpolate(value); err != nil {
+				return err
+			}
+
+			if !strings.HasSuffix(key.Value, FileSuffix) || value.Kind != yaml.ScalarNode {
+				continue
+			}
+
+			secret, err := readSecret(value.Value)
+			if err != nil {
+				return errors.Wrapf(err, "line %d", key.Line)
+			}
+
+			key.Value = strings.TrimSuffix(key.Value, FileSuffix)
+			value.Value = secret
+			value.Tag = "!!str"
+			value.Style = yaml.DoubleQuotedStyle
+		}
+	default:
+		for _, n := range node.Content {
+			if err := interpolate(n); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// applyEnv overrides the fields of the given struct by the environment variables.
+// The fields of the inline structs are overridden as the fields of v.
+// List values are separated by newlines, or by commas when there is no newline.
+// Map values (e.g. hosts or restrictions.users) are YAML mappings.
+// The lists tagged `env:"lines"` (e.g. urlfilter rules whose modifiers contain commas) are only separated by newlines.
+func applyEnv(v reflect.Value, prefix string) (bool, error) {
+	var set bool
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, options, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		fv := v.Field(i)
+
+		if name == "" && options == "inline" {
+			ok, err := applyEnv(fv, prefix)
+			if err != nil {
+				return false, err
+			}
+			set = set || ok
+			continue
+		}
+		if name == "" || name == "-" {
+			continue
+		}
+
+		env := prefix + "_" + strings.ToUpper(name)
+
+		if field.Type.Kind() == reflect.Struct && field.Type != reflect.TypeOf(time.Duration(0)) {
+			ok, err := applyEnv(fv, env)
+			if err != nil {
+				return false, err
+			}
+			set = set || ok
+			continue
+		}
+
+		if field.Type.Kind() == reflect.Pointer && field.Type.Elem().Kind() == reflect.Struct {
+			ptr := reflect.New(field.Type.Elem())
+			if !fv.IsNil() {
+				ptr.Elem().Set(fv.Elem())
+			}
+
+			ok, err := applyEnv(ptr.Elem(), env)
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				fv.Set(ptr)
+				set = true
+			}
+			continue
+		}
+
+		value, _, ok, err := lookupEnv(env)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			continue
+		}
+
+		if err := setValue(fv, value, field.Tag.Get("env") == "lines"); err != nil {
+			return false, errors.Wrap(err, env)
+		}
+		set = true
+	}
+
+	return set, nil
+}
+
+// lookupEnv returns the value of the given environment variable, or the content of the file given by its _FILE variant,
+// and its source (the variable or the file).
+func lookupEnv(env string) (value, source string, ok bool, err error) {
+	if value, ok = os.LookupEnv(env); ok {
+		return value, env, true, nil
+	}
+
+	filename, ok := os.LookupEnv(env + strings.ToUpper(FileSuffix))
+	if !ok {
+		return "", "", false, nil
+	}
+
+	if value, err = readSecret(filename); err != nil {
+		return "", "", false, errors.Wrap(err, env+strings.ToUpper(FileSuffix))
+	}
+	return value, filename, true, nil
+}
+
+func setValue(v reflect.Value, value string, lines bool) error {
+	switch v.Interface().(type) {
+	case string:
+		v.SetString(value)
+	case []string:
+		sep := ","
+		if lines || strings.Contains(value, "\n") {
+			sep = "\n"
+		}
+
+		var values []string
+		for _, s := range strings.Split(value, sep) {
+			if s = strings.TrimSpace(s); s != "" {
+				values = append(values, s)
+			}
+		}
+		v.Set(reflect.ValueOf(values))
+	case time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(&b))
+	case int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	default:
+		if v.Kind() != reflect.Map {
+			return errors.Errorf("unsupported type %s", v.Type())
+		}
+
+		// Maps are given as YAML flow mappings (e.g. {a.example: 192.0.2.1, b.example: [192.0.2.2, "2001:db8::2"]})
+		m := reflect.New(v.Type())
+		decoder := yaml.NewDecoder(strings.NewReader(value))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(m.Interface()); err != nil {
+			return err
+		}
+		v.Set(m.Elem())
+	}
+	return nil
+}
+
+// readSecret returns the content of the given file without its trailing newlines.
+func readSecret(filename string) (string, error) {
+	payload, err := os.ReadFile(filename)
+	if err != nil {
+		return "", errors.Wrap(err, "could not read secret")
+	}
+	return strings.TrimRight(string(payload), "\r\n"), nil
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigFromEnv(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "authorization")
+	if err := os.WriteFile(secret, []byte("alice:secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("ERGO_DENYLIST", "||ads.test^$third-party,script")
+	t.Setenv("ERGO_ALLOWLIST", "||a.test^$dnstype=A,AAAA\n||b.test^\n")
+	t.Setenv("ERGO_DENYLISTS", "/etc/ergo/lists, https://example.com/list.txt")
+	t.Setenv("ERGO_MITM_DOMAINS", "||intercepted.test^$important,badfilter")
+	t.Setenv("ERGO_AUTHORIZATION_FILE", secret)
+	t.Setenv("ERGO_DENYLISTS_REFRESH", "1h")
+	t.Setenv("ERGO_RESTRICTIONS_IP_LITERALS", "false")
+	t.Setenv("ERGO_CACHE_SIZE", "100")
+	t.Setenv("ERGO_NAMESERVER_STRATEGY", "race")
+	t.Setenv("ERGO_HOSTS", `{a.test: 192.0.2.1, "*.b.test": [192.0.2.2, "2001:db8::2"]}`)
+	t.Setenv("ERGO_RESTRICTIONS_USERS", "{alice: {connect_ports: [22, 443]}}")
+
+	config, err := LoadConfig("", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect(t, "denylist", config.DenyList, []string{"||ads.test^$third-party,script"})
+	expect(t, "allowlist", config.AllowList, []string{"||a.test^$dnstype=A,AAAA", "||b.test^"})
+	expect(t, "denylists", config.DenyLists, []string{"/etc/ergo/lists", "https://example.com/list.txt"})
+	expect(t, "authorization", config.Authorization, "alice:secret")
+	expect(t, "denylists_refresh", config.DenyListsRefresh, time.Hour)
+	expect(t, "cache_size", config.Cache.Size, 100)
+	expect(t, "nameserver_strategy", config.Pool.Strategy, "race")
+	expect(t, "hosts", config.Hosts, map[string]IPs{"a.test": {"192.0.2.1"}, "*.b.test": {"192.0.2.2", "2001:db8::2"}})
+	expect(t, "restrictions.users", config.Restrictions.Users, map[string]Restrictions{"alice": {ConnectPorts: []string{"22", "443"}}})
+	if config.Restrictions.IPLiterals == nil || *config.Restrictions.IPLiterals {
+		t.Errorf("restrictions.ip_literals = %v, expected false", config.Restrictions.IPLiterals)
+	}
+	if config.MITM == nil {
+		t.Fatal("mitm is not set")
+	}
+	expect(t, "mitm.domains", config.MITM.Domains, []string{"||intercepted.test^$important,badfilter"})
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "authorization")
+	if err := os.WriteFile(secret, []byte("bob:password\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	filename := filepath.Join(dir, "ergo.yml")
+	err := os.WriteFile(filename, []byte(`
+addr: ${ERGO_TEST_HOST:-localhost}:${ERGO_TEST_PORT}
+authorization_file: `+secret+`
+denylist:
+  - "||${ERGO_TEST_DOMAIN}^$third-party,script"
+denylists_refresh: ${ERGO_TEST_REFRESH}
+cache_min_ttl: 1m
+nameserver_max_fails: 5
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("ERGO_TEST_PORT", "4242")
+	t.Setenv("ERGO_TEST_DOMAIN", "ads.test")
+	t.Setenv("ERGO_TEST_REFRESH", "2h")
+
+	config, err := LoadConfig(filename, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect(t, "addr", config.Address, "localhost:4242")
+	expect(t, "authorization", config.Authorization, "bob:password")
+	expect(t, "denylist", config.DenyList, []string{"||ads.test^$third-party,script"})
+	expect(t, "denylists_refresh", config.DenyListsRefresh, 2*time.Hour)
+	expect(t, "cache_min_ttl", config.Cache.MinTTL, time.Minute)
+	expect(t, "nameserver_max_fails", config.Pool.MaxFails, 5)
+
+	// The environment overrides the file
+	t.Setenv("ERGO_DENYLIST", "||other.test^")
+	if config, err = LoadConfig(filename, true); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, "denylist", config.DenyList, []string{"||other.test^"})
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	t.Setenv("ERGO_AUTHORIZATION_FILE", filepath.Join(t.TempDir(), "missing"))
+	if _, err := LoadConfig("", true); err == nil {
+		t.Error("missing secret file is not reported")
+	}
+
+	os.Unsetenv("ERGO_AUTHORIZATION_FILE")
+	t.Setenv("ERGO_DENYLISTS_REFRESH", "forever")
+	if _, err := LoadConfig("", true); err == nil {
+		t.Error("invalid duration is not reported")
+	}
+
+	os.Unsetenv("ERGO_DENYLISTS_REFRESH")
+	t.Setenv("ERGO_RESTRICTIONS_USERS", "{alice: {ports: [22]}}")
+	if _, err := LoadConfig("", true); err == nil {
+		t.Error("unknown map field is not reported")
+	}
+}
+
+func TestValidateRules(t *testing.T) {
+	dir := t.TempDir()
+	bypass := filepath.Join(dir, "bypass")
+	if err := os.WriteFile(bypass, []byte("||bank.test^\n||broken.test^$bogus\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	filename := filepath.Join(dir, "ergo.yml")
+	err := os.WriteFile(filename, []byte(`denylist:
+  - "||ads.test^"
+  - "||ads.test^$${ERGO_TEST_MODIFIER}"
+allowlist:
+  - "||overridden.test^$bogus"
+mitm:
+  domains:
+    - "||intercepted.test^"
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("ERGO_TEST_MODIFIER", "bogus")
+	t.Setenv("ERGO_ALLOWLIST", "||a.test^\n||b.test^$dnstype=BOGUS")
+	t.Setenv("ERGO_MITM_BYPASS_FILE", bypass)
+
+	errs, err := ValidateRules(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reported []string
+	for _, err := range errs {
+		reported = append(reported, fmt.Sprintf("%s:%d %s", err.Source, err.Line, err.Rule))
+	}
+	expect(t, "invalid rules", reported, []string{
+		filename + ":3 ||ads.test^$bogus",
+		"ERGO_ALLOWLIST:2 ||b.test^$dnstype=BOGUS",
+		bypass + ":2 ||broken.test^$bogus",
+	})
+}
+
+func expect(t *testing.T, name string, actual, expected any) {
+	t.Helper()
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("%s = %#v, expected %#v", name, actual, expected)
+	}
+}
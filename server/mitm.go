@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"net"
+	nethttp "net/http"
+
+	"github.com/mdouchement/ergo/http"
+	"github.com/mdouchement/ergo/mitm"
+	"github.com/mdouchement/ergo/resolver"
+	"github.com/mdouchement/ergo/tcp"
+	"github.com/pkg/errors"
+)
+
+// intercept terminates the TLS of the CONNECT tunnel and relays its requests to the upstream.
+// The requests are always relayed to the checked CONNECT target name, the ones with another Host header are rejected
+// and their methods are checked against the restrictions of the user.
+func (s *Server) intercept(ctx context.Context, c net.Conn, header http.Header, user, name string) {
+	log := s.Logger.WithField("connect", header.Host())
+	restrictions := s.restrictionsOf(user)
+
+	err := s.interceptor.Intercept(ctx, c, &mitm.Session{
+		Host:    name,
+		Address: net.JoinHostPort(name, header.Port()),
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, err
+			}
+
+			result, err := s.Resolver.Resolve(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+
+			return s.Dialer(resolver.WithHost(ctx, result.Name), network, net.JoinHostPort(result.IP.String(), port))
+		},
+		Filter: func(r *nethttp.Request) error {
+			if err := restrictions.checkMethod(r.Method, name, header.Port()); err != nil {
+				return err
+			}
+			if !sameAddress(r.Host, name, header.Port()) {
+				return &resolver.RejectedError{Kind: "misdirected", Target: r.Method + " " + r.Host}
+			}
+
+			_, err := s.Resolver.Resolve(r.Context(), r.URL.Hostname())
+			if err != nil {
+				return err
+			}
+
+			return s.filterURL(r.Context(), resolver.NewURLRequest(r.Method, r.URL.String(), r.Header))
+		},
+		Reject: func(w nethttp.ResponseWriter, r *nethttp.Request, err error) {
+			var rejected *resolver.RejectedError
+			if !errors.As(err, &rejected) {
+				nethttp.Error(w, nethttp.StatusText(nethttp.StatusForbidden), nethttp.StatusForbidden)
+				return
+			}
+
+			if rejected.Rule != "" {
+				w.Header().Set(RuleHeader, rejected.Rule)
+			}
+			nethttp.Error(w, rejected.Error(), nethttp.StatusForbidden)
+		},
+		Log: func(r *nethttp.Request, status int, err error) {
+			log := log.WithField("status", status)
+			if err != nil {
+				log = log.WithError(err)
+			}
+
+			switch {
+			case status == nethttp.StatusForbidden:
+				log.Warnf("[mitm] %s %s", r.Method, r.URL)
+			case err != nil && !tcp.IsIgnorableError(err) && !errors.Is(err, context.Canceled):
+				log.Errorf("[mitm] %s %s", r.Method, r.URL)
+			default:
+				log.Infof("[mitm] %s %s", r.Method, r.URL)
+			}
+		},
+	})
+	if err != nil && !tcp.IsIgnorableError(err) {
+		log.WithError(err).Error("interception failure")
+	}
+}
+
+// sameAddress returns true when the Host header of an intercepted request is the CONNECT target name and port
+// (443 when omitted).
+func sameAddress(hostHeader, name, port string) bool {
+	host, hport, err := net.SplitHostPort(hostHeader)
+	if err != nil {
+		host, hport = hostHeader, "443"
+	}
+
+	host, err = resolver.NormalizeHost(host)
+	return err == nil && host == name && hport == port
+}
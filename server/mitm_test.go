@@ -0,0 +1,29 @@
+package server
+
+import "testing"
+
+func TestSameAddress(t *testing.T) {
+	tests := []struct {
+		host     string
+		name     string
+		port     string
+		expected bool
+	}{
+		{"example.com", "example.com", "443", true},
+		{"example.com:443", "example.com", "443", true},
+		{"EXAMPLE.com.:443", "example.com", "443", true},
+		{"example.com:8443", "example.com", "8443", true},
+		{"example.com", "example.com", "8443", false},
+		{"example.com:25", "example.com", "443", false},
+		{"internal:25", "example.com", "443", false},
+		{"internal", "example.com", "443", false},
+		{"[::1]:443", "::1", "443", true},
+		{"", "example.com", "443", false},
+	}
+
+	for _, test := range tests {
+		if actual := sameAddress(test.host, test.name, test.port); actual != test.expected {
+			t.Errorf("sameAddress(%q, %q, %q) = %v, expected %v", test.host, test.name, test.port, actual, test.expected)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/mdouchement/ergo/resolver"
+	"github.com/pkg/errors"
+)
+
+// Default allowed destination ports.
+var (
+	DefaultConnectPorts = []string{"443", "8443"}
+	DefaultHTTPPorts    = []string{"80", "1025-65535"}
+)
+
+// Restrictions holds the destination ports and methods allowed to the clients.
+type Restrictions struct {
+	// ConnectPorts is the list of ports or port ranges (e.g. 8000-8999) allowed for CONNECT requests.
+	ConnectPorts []string `yaml:"connect_ports"`
+	// HTTPPorts is the list of ports or port ranges allowed for plain HTTP requests.
+	HTTPPorts []string `yaml:"http_ports"`
+	// Methods is the list of allowed methods. All methods are allowed when empty.
+	Methods []string `yaml:"methods"`
+	// IPLiterals allows requests to raw IP addresses instead of domain names (default true).
+	IPLiterals *bool `yaml:"ip_literals"`
+	// Users overrides the restrictions per authenticated user.
+	Users map[string]Restrictions `yaml:"users"`
+}
+
+type (
+	restrictions struct {
+		connect    ports
+		http       ports
+		methods    map[string]bool
+		ipLiterals bool
+	}
+
+	ports []portRange
+
+	portRange struct {
+		from int
+		to   int
+	}
+)
+
+// compileRestrictions returns the global restrictions and the restrictions of each user.
+func compileRestrictions(config Restrictions) (*restrictions, map[string]*restrictions, error) {
+	base := &restrictions{ipLiterals: true}
+	if err := base.override(Restrictions{
+		ConnectPorts: DefaultConnectPorts,
+		HTTPPorts:    DefaultHTTPPorts,
+	}); err != nil {
+		return nil, nil, err
+	}
+	if err := base.override(config); err != nil {
+		return nil, nil, err
+	}
+
+	users := map[string]*restrictions{}
+	for user, uconfig := range config.Users {
+		r := *base
+		if err := r.override(uconfig); err != nil {
+			return nil, nil, errors.Wrapf(err, "user %s", user)
+		}
+		users[user] = &r
+	}
+
+	return base, users, nil
+}
+
+func (r *restrictions) override(config Restrictions) (err error) {
+	if len(config.ConnectPorts) > 0 {
+		if r.connect, err = parsePorts(config.ConnectPorts); err != nil {
+			return errors.Wrap(err, "connect_ports")
+		}
+	}
+	if len(config.HTTPPorts) > 0 {
+		if r.http, err = parsePorts(config.HTTPPorts); err != nil {
+			return errors.Wrap(err, "http_ports")
+		}
+	}
+	if len(config.Methods) > 0 {
+		r.methods = map[string]bool{}
+		for _, method := range config.Methods {
+			r.methods[strings.ToUpper(method)] = true
+		}
+	}
+	if config.IPLiterals != nil {
+		r.ipLiterals = *config.IPLiterals
+	}
+	return nil
+}
+
+// check returns an error when the request is not allowed.
+func (r *restrictions) check(method, host, port string) error {
+	if err := r.checkMethod(method, host, port); err != nil {
+		return err
+	}
+
+	if !r.ipLiterals && net.ParseIP(host) != nil {
+		return &resolver.RejectedError{Kind: "ip literal", Rule: "ip_literals", Target: method + " " + net.JoinHostPort(host, port)}
+	}
+
+	allowed, rule := r.http, "http_ports"
+	if method == "CONNECT" {
+		allowed, rule = r.connect, "connect_ports"
+	}
+	if !allowed.contains(port) {
+		return &resolver.RejectedError{Kind: "port", Rule: rule, Target: method + " " + net.JoinHostPort(host, port)}
+	}
+
+	return nil
+}
+
+// checkMethod returns an error when the method is not allowed.
+func (r *restrictions) checkMethod(method, host, port string) error {
+	if r.methods != nil && !r.methods[method] {
+		return &resolver.RejectedError{Kind: "method", Rule: "methods", Target: method + " " + net.JoinHostPort(host, port)}
+	}
+	return nil
+}
+
+func parsePorts(values []string) (ports, error) {
+	var p ports
+	for _, value := range values {
+		from, to, isRange := strings.Cut(value, "-")
+		if !isRange {
+			to = from
+		}
+
+		var r portRange
+		var err error
+		if r.from, err = strconv.Atoi(strings.TrimSpace(from)); err != nil {
+			return nil, errors.Wrapf(err, "invalid port %q", value)
+		}
+		if r.to, err = strconv.Atoi(strings.TrimSpace(to)); err != nil {
+			return nil, errors.Wrapf(err, "invalid port %q", value)
+		}
+		if r.from < 1 || r.to > 65535 || r.from > r.to {
+			return nil, errors.Errorf("invalid port %q", value)
+		}
+
+		p = append(p, r)
+	}
+	return p, nil
+}
+
+func (p ports) contains(port string) bool {
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return false
+	}
+
+	for _, r := range p {
+		if r.from <= n && n <= r.to {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mdouchement/ergo/resolver"
+)
+
+func TestRestrictions(t *testing.T) {
+	no := false
+	base, users, err := compileRestrictions(Restrictions{
+		Users: map[string]Restrictions{
+			"alice": {ConnectPorts: []string{"22", "1000-2000"}, Methods: []string{"get", "CONNECT"}},
+			"bob":   {IPLiterals: &no, HTTPPorts: []string{"8080"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user    string
+		method  string
+		host    string
+		port    string
+		allowed bool
+	}{
+		// Defaults
+		{"", "CONNECT", "example.com", "443", true},
+		{"", "CONNECT", "example.com", "8443", true},
+		{"", "CONNECT", "example.com", "80", false},
+		{"", "CONNECT", "example.com", "22", false},
+		{"", "GET", "example.com", "80", true},
+		{"", "GET", "example.com", "443", false},
+		{"", "GET", "example.com", "1024", false},
+		{"", "GET", "example.com", "1025", true},
+		{"", "POST", "example.com", "65535", true},
+		{"", "GET", "example.com", "65536", false},
+		{"", "GET", "example.com", "0", false},
+		{"", "GET", "example.com", "", false},
+		{"", "GET", "example.com", "http", false},
+		{"", "DELETE", "10.0.0.1", "80", true},
+		// Ports and methods overridden
+		{"alice", "CONNECT", "example.com", "22", true},
+		{"alice", "CONNECT", "example.com", "999", false},
+		{"alice", "CONNECT", "example.com", "1000", true},
+		{"alice", "CONNECT", "example.com", "2000", true},
+		{"alice", "CONNECT", "example.com", "2001", false},
+		{"alice", "CONNECT", "example.com", "443", false},
+		{"alice", "GET", "example.com", "80", true},
+		{"alice", "GET", "example.com", "1025", true},
+		{"alice", "POST", "example.com", "80", false},
+		// IP literals and HTTP ports overridden
+		{"bob", "GET", "example.com", "8080", true},
+		{"bob", "GET", "example.com", "80", false},
+		{"bob", "GET", "10.0.0.1", "8080", false},
+		{"bob", "CONNECT", "::1", "443", false},
+		{"bob", "CONNECT", "example.com", "443", true},
+	}
+
+	for _, test := range tests {
+		r := base
+		if test.user != "" {
+			r = users[test.user]
+		}
+
+		err := r.check(test.method, test.host, test.port)
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("%s: check(%s %s:%s) = %v, expected allowed: %v", test.user, test.method, test.host, test.port, err, test.allowed)
+		}
+		if err != nil && !errors.Is(err, resolver.ErrHostRejected) {
+			t.Errorf("%s: check(%s %s:%s) = %v, expected a rejection", test.user, test.method, test.host, test.port, err)
+		}
+	}
+}
+
+func TestRestrictionsOf(t *testing.T) {
+	srv, err := New(Config{
+		Restrictions: Restrictions{
+			Users: map[string]Restrictions{"alice": {ConnectPorts: []string{"22"}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = srv.restrictionsOf("alice").check("CONNECT", "example.com", "22"); err != nil {
+		t.Errorf("alice: %v", err)
+	}
+	for _, user := range []string{"", "bob"} {
+		if err = srv.restrictionsOf(user).check("CONNECT", "example.com", "22"); err == nil {
+			t.Errorf("%q: the restrictions of alice are applied", user)
+		}
+	}
+}
+
+func TestParsePorts(t *testing.T) {
+	for _, value := range []string{"1", "65535", "1-65535", " 80 - 81 ", "443-443"} {
+		if _, err := parsePorts([]string{value}); err != nil {
+			t.Errorf("parsePorts(%q) = %v", value, err)
+		}
+	}
+	for _, value := range []string{"0", "65536", "0-80", "80-65536", "81-80", "http", "80-", "-80", ""} {
+		if _, err := parsePorts([]string{value}); err == nil {
+			t.Errorf("parsePorts(%q) is valid, expected an error", value)
+		}
+	}
+}
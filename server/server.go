@@ -4,190 +4,681 @@ import (
 	"context"
 	"fmt"
 	"net"
-	"os"
-	"regexp"
+	nethttp "net/http"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/mdouchement/ergo/http"
+	"github.com/mdouchement/ergo/mitm"
 	"github.com/mdouchement/ergo/resolver"
 	"github.com/mdouchement/ergo/tcp"
 	"github.com/mdouchement/logger"
 	"github.com/pkg/errors"
-	"github.com/spf13/cobra"
-	"gopkg.in/yaml.v3"
 )
 
-type configuration struct {
-	*resolver.NameResolver
-	Address       string   `yaml:"addr"`
-	Authorization string   `yaml:"authorization"`
-	NameServer    string   `yaml:"force_nameserver"`
-	Logger        string   `yaml:"logger"`
-	DenyList      []string `yaml:"denylist"`
-}
-
-// Command is used to launch Ergo proxy server.
-func Command() *cobra.Command {
-	var cfg string
-
-	c := &cobra.Command{
-		Use:   "server",
-		Short: "Starts the Ergo proxy server",
-		Args:  cobra.ExactArgs(0),
-		RunE: func(_ *cobra.Command, _ []string) error {
-			if cfg == "" {
-				cfg = "ergo.yml"
-			}
+// DefaultListsRefresh is the default interval between two refreshes of the deny lists.
+const DefaultListsRefresh = 24 * time.Hour
 
-			lopts := &logger.SlogTextOption{
-				DisableColors:   false,
-				ForceColors:     true,
-				ForceFormatting: true,
-				PrefixRE:        regexp.MustCompile(`^(\[.*?\])\s`),
-				FullTimestamp:   true,
-				TimestampFormat: "2006-01-02 15:04:05",
-			}
-			log := logger.WrapSlogHandler(logger.NewSlogTextHandler(os.Stdout, lopts))
+// DefaultCacheSaveInterval is the default interval between two saves of the name resolutions cache.
+const DefaultCacheSaveInterval = 5 * time.Minute
 
-			//
+// RuleHeader is the header of the 403 responses reporting the rule rejecting the request.
+const RuleHeader = "X-Ergo-Rule"
 
-			var config configuration
-			{
+// ErrServerClosed is returned by Serve and ListenAndServe after a call to Shutdown.
+var ErrServerClosed = errors.New("ergo: server closed")
 
-				log.Infof("Reading configuration from %s", cfg)
-				payload, err := os.ReadFile(cfg)
-				if err != nil {
-					return errors.Wrapf(err, "could not read configuration file %s", cfg)
-				}
+type (
+	// An Authenticator reports whether the given credentials are allowed to use the proxy.
+	Authenticator func(user, password string) bool
 
-				err = yaml.Unmarshal(payload, &config)
-				if err != nil {
-					return errors.Wrapf(err, "could not parse configuration file %s", cfg)
-				}
+	// A Resolver returns the IP to dial for the given domain name.
+	// It returns an error when the domain name must not be proxified.
+	// See the resolver package to compose a Resolver from the layers of the default one.
+	Resolver = resolver.Resolver
 
-				if config.Logger != "" {
-					lopts.Level, err = logger.ParseSlogLevel(config.Logger)
-					if err != nil {
-						return errors.Wrapf(err, "could not parse logger level %s", cfg)
-					}
+	// A URLFilter returns an error when the full URL of an HTTP request must not be proxified.
+	// It is used when the Resolver implements it.
+	URLFilter interface {
+		FilterURL(ctx context.Context, req resolver.URLRequest) error
+	}
 
-					log = logger.WrapSlogHandler(logger.NewSlogTextHandler(os.Stdout, lopts))
-				}
+	// An IPFilter returns an error when the given IP must not be proxified.
+	// It is used when the Resolver implements it.
+	IPFilter interface {
+		FilterIP(ctx context.Context, ip net.IP) error
+	}
 
-				config.NameResolver, err = resolver.New(config.NameServer, config.DenyList)
-				if err != nil {
-					return errors.Wrapf(err, "could not build name resolver %s", cfg)
-				}
-			}
+	// A Dialer opens the connection to the remote.
+	Dialer func(ctx context.Context, network, address string) (net.Conn, error)
+)
 
-			//
-			//
-			//
+// A Server is an Ergo proxy server.
+//
+// The hook fields can be replaced after New and before Serve.
+type Server struct {
+	// Logger is the logger used by the server.
+	Logger logger.Logger
+	// Authenticator checks the Proxy-Authorization credentials.
+	// A nil Authenticator disables the authentication.
+	Authenticator Authenticator
+	// Resolver resolves and filters the requested domain names.
+	Resolver Resolver
+	// Dialer opens the connections to the remotes.
+	Dialer Dialer
 
-			if config.Authorization != "" {
-				log.Info("Authorization enabled")
-			} else {
-				log.Info("Authorization disabled")
-			}
+	config       Config
+	restrictions *restrictions
+	users        map[string]*restrictions
+	interceptor  *mitm.Interceptor
+	names        *resolver.NameResolver
+	lists        *resolver.ListLoader
+	start        sync.Once
 
-			if config.NameServer != "" {
-				log.Info("Name server forced to", config.NameServer)
-			}
+	mu        sync.Mutex
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	admins    map[*nethttp.Server]struct{}
+	wg        sync.WaitGroup
+}
 
-			log.Info("Listening on ", config.Address)
-			l, err := net.Listen("tcp", config.Address)
+// New returns a new Server built from the given configuration.
+func New(config Config) (*Server, error) {
+	r, err := resolver.New(config.Config)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not build name resolver")
+	}
+
+	switch config.SNIInspection {
+	case "", SNIInspectionLog, SNIInspectionEnforce, SNIInspectionStrict:
+	default:
+		return nil, errors.Errorf("unsupported sni_inspection mode: %q", config.SNIInspection)
+	}
+
+	s := &Server{
+		Logger:    logger.NewNullLogger(),
+		Resolver:  r,
+		names:     r,
+		Dialer:    (&net.Dialer{KeepAlive: 15 * time.Second, ControlContext: r.DialControlContext}).DialContext,
+		config:    config,
+		listeners: map[net.Listener]struct{}{},
+		conns:     map[net.Conn]struct{}{},
+		admins:    map[*nethttp.Server]struct{}{},
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	r.OnMonitor = func(rejected *resolver.RejectedError) {
+		s.Logger.Warn("allowed by monitor mode: ", rejected)
+	}
+
+	s.restrictions, s.users, err = compileRestrictions(config.Restrictions)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not build restrictions")
+	}
+
+	if len(config.Hosts) > 0 || len(config.HostsFiles) > 0 {
+		hosts := map[string][]string{}
+		for _, filename := range config.HostsFiles {
+			entries, err := resolver.LoadHostsFile(filename)
 			if err != nil {
-				return errors.Wrap(err, "could not listen")
+				return nil, errors.Wrap(err, "could not load hosts")
 			}
+			for host, ips := range entries {
+				hosts[host] = append(hosts[host], ips...)
+			}
+		}
+		for host, ips := range config.Hosts {
+			hosts[host] = ips // The configuration takes precedence over the files
+		}
+
+		if err = r.SetHosts(hosts); err != nil {
+			return nil, errors.Wrap(err, "could not build hosts")
+		}
+	}
+
+	for _, source := range config.DenyListsMonitor {
+		if !slices.Contains(config.DenyLists, source) {
+			return nil, errors.Errorf("monitored deny list %q is not a deny list", source)
+		}
+	}
+
+	if len(config.DenyLists) > 0 {
+		s.lists = resolver.NewListLoader(config.DenyLists, config.DenyListsCache)
+
+		lists, err := s.loadLists()
+		if err != nil {
+			return nil, errors.Wrap(err, "could not load deny lists")
+		}
+
+		if err = r.SetLists(lists); err != nil {
+			return nil, errors.Wrap(err, "could not build deny lists")
+		}
+	}
+
+	if config.AdminStatePath != "" {
+		if _, err = r.LoadRules(config.AdminStatePath); err != nil {
+			return nil, errors.Wrap(err, "could not load admin state")
+		}
+	}
+
+	if config.CachePath != "" {
+		// Loaded once the hosts and the deny lists are set as they flush the cache
+		if _, err = r.LoadCache(config.CachePath); err != nil {
+			return nil, errors.Wrap(err, "could not load cache")
+		}
+	}
+
+	if config.MITM != nil {
+		s.interceptor, err = mitm.New(*config.MITM)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not build TLS interceptor")
+		}
+	}
+
+	if config.Authorization != "" {
+		s.Authenticator = func(user, password string) bool {
+			return fmt.Sprintf("%s:%s", user, password) == config.Authorization
+		}
+	}
+
+	return s, nil
+}
+
+// Config returns the configuration used to build the server.
+func (s *Server) Config() Config {
+	return s.config
+}
+
+// ListenAndServe listens on the configured addresses and then calls Serve, ServeTransparent and ServeAdmin.
+// It returns as soon as one of them returns.
+func (s *Server) ListenAndServe() error {
+	type service struct {
+		name    string
+		address string
+		serve   func(net.Listener) error
+	}
+
+	services := []service{{name: "Listening", address: s.config.Address, serve: s.Serve}}
+	if s.config.TransparentAddress != "" {
+		services = append(services, service{name: "Listening transparently", address: s.config.TransparentAddress, serve: s.ServeTransparent})
+	}
+	if s.config.AdminAddress != "" {
+		if err := s.checkAdmin(); err != nil {
+			return err
+		}
+		services = append(services, service{name: "Admin API listening", address: s.config.AdminAddress, serve: s.ServeAdmin})
+	}
+
+	listeners := make([]net.Listener, 0, len(services))
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
 
-			for {
-				c, err := l.Accept()
-				if err != nil {
-					if !tcp.IsIgnorableError(err) {
-						log.WithError(err).Error("could not accept")
-					}
-					continue
-				}
-
-				go func() {
-					defer c.Close()
-					c.(*net.TCPConn).SetKeepAlive(true)
-
-					c, header, err := http.Proxy(c)
-					if err != nil {
-						log.Error(err)
-						return
-					}
-
-					//
-					// Authorization
-					//
-
-					if config.Authorization != "" {
-						const payload = "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"Access to internal site\"\r\n\r\n"
-
-						user, password, ok := header.ProxyBasicAuth()
-						if !ok {
-							log.Info(header.String())
-							log.Error("no autorization provided")
-							c.Write([]byte(payload))
-							return
-						}
-						if fmt.Sprintf("%s:%s", user, password) != config.Authorization {
-							log.Info(header.String())
-							log.Error("invalid autorization provided")
-							c.Write([]byte(payload))
-							return
-						}
-					}
-
-					//
-					// Deny check
-					//
-
-					var ip net.IP
-					{
-						_, ip, err = config.Resolve(context.Background(), header.Domain())
-						if err != nil {
-							const payload = "HTTP/1.1 403 Forbidden\r\n\r\n"
-							log.Info(header.String())
-							log.Warn(err)
-							c.Write([]byte(payload))
-							return
-						}
-					}
-
-					//
-					// TCP pipeline
-					//
-
-					pipe, err := tcp.NewPipeTCP(c, net.JoinHostPort(ip.String(), header.Port()))
-					if err != nil {
-						if !tcp.IsIgnorableError(err) {
-							log.WithError(err).Error("failed to establish pipe")
-						}
-						return
-					}
-					defer pipe.Close()
-
-					log.WithFields(logger.M{
-						"local":  fmt.Sprintf("%s/%s", pipe.LocalConn().LocalAddr(), pipe.LocalConn().RemoteAddr()),
-						"remote": fmt.Sprintf("%s/%s", pipe.RemoteConn().LocalAddr(), pipe.RemoteConn().RemoteAddr()),
-					}).Infof("%s %s", header.Method, header.Host())
-
-					if header.Method == "CONNECT" {
-						// Once connected successfully, return OK
-						c.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
-					}
-
-					err = pipe.Relay()
-					if err != nil && !tcp.IsIgnorableError(err) {
-						log.WithError(err).Error("pipe failure")
-					}
-				}()
+	for _, service := range services {
+		s.Logger.Infof("%s on %s", service.name, service.address)
+		l, err := net.Listen("tcp", service.address)
+		if err != nil {
+			return errors.Wrapf(err, "could not listen on %s", service.address)
+		}
+		listeners = append(listeners, l)
+	}
+
+	errs := make(chan error, len(services))
+	for i, service := range services {
+		go func() {
+			errs <- service.serve(listeners[i])
+		}()
+	}
+
+	return <-errs
+}
+
+// Serve accepts incoming connections on the listener l and proxifies them.
+// Serve always closes l and returns a non-nil error.
+func (s *Server) Serve(l net.Listener) error {
+	return s.serve(l, s.handle)
+}
+
+// ServeTransparent accepts incoming connections redirected by netfilter on the listener l
+// and relays them to their original destination.
+// ServeTransparent always closes l and returns a non-nil error.
+func (s *Server) ServeTransparent(l net.Listener) error {
+	return s.serve(l, s.handleTransparent)
+}
+
+func (s *Server) serve(l net.Listener, handle func(context.Context, net.Conn)) error {
+	s.start.Do(s.background)
+
+	if !s.track(l) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.untrack(l)
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return errors.Wrap(err, "could not accept")
 			}
-		},
+			if !tcp.IsIgnorableError(err) {
+				s.Logger.WithError(err).Error("could not accept")
+			}
+			continue
+		}
+
+		if !s.trackConn(c) {
+			c.Close()
+			return ErrServerClosed
+		}
+
+		go func() {
+			defer s.untrackConn(c)
+			defer c.Close()
+
+			// The context of the connection is cancelled when it is done or when the server is closed.
+			ctx, cancel := context.WithCancel(s.ctx)
+			defer cancel()
+
+			handle(ctx, c)
+		}()
+	}
+}
+
+// Shutdown gracefully shuts down the server. It closes all the listeners and waits
+// for the active connections to be relayed until the context is done.
+// Then all remaining connections are closed and the context's error is returned.
+// The name resolutions are saved when a cache file is configured.
+func (s *Server) Shutdown(ctx context.Context) error {
+	defer s.saveCache()
+
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for srv := range s.admins {
+		srv.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		s.cancel()
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.cancel()
+	s.mu.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+
+	return ctx.Err()
+}
+
+// background starts the background tasks of the server until its shutdown.
+func (s *Server) background() {
+	if s.lists != nil {
+		go s.refreshLists()
+	}
+	if s.config.CachePath != "" {
+		go s.saveCachePeriodically()
+	}
+	go s.expireRules()
+}
+
+func (s *Server) expireRules() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		n, err := s.names.ExpireRules()
+		if err != nil {
+			s.Logger.WithError(err).Error("could not expire rules")
+			continue
+		}
+		if n > 0 {
+			s.Logger.Infof("Expired rules removed (%d rules)", n)
+			s.saveRules()
+		}
+	}
+}
+
+func (s *Server) saveRules() {
+	if s.config.AdminStatePath == "" {
+		return
+	}
+
+	if err := s.names.SaveRules(s.config.AdminStatePath); err != nil {
+		s.Logger.WithError(err).Error("could not save admin state")
 	}
-	c.Flags().StringVarP(&cfg, "config", "c", os.Getenv("ERGO_PROXY_CONFIG"), "Server's configuration")
+}
+
+func (s *Server) saveCachePeriodically() {
+	interval := s.config.CacheSaveInterval
+	if interval <= 0 {
+		interval = DefaultCacheSaveInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.saveCache()
+	}
+}
+
+func (s *Server) saveCache() {
+	if s.config.CachePath == "" {
+		return
+	}
+
+	if err := s.names.SaveCache(s.config.CachePath); err != nil {
+		s.Logger.WithError(err).Error("could not save cache")
+	}
+}
+
+func (s *Server) refreshLists() {
+	interval := s.config.DenyListsRefresh
+	if interval <= 0 {
+		interval = DefaultListsRefresh
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		lists, err := s.loadLists()
+		if err != nil {
+			s.Logger.WithError(err).Error("could not refresh deny lists")
+			continue
+		}
+
+		if err = s.names.SetLists(lists); err != nil {
+			s.Logger.WithError(err).Error("could not build deny lists")
+			continue
+		}
+
+		s.Logger.Infof("Deny lists refreshed (%d lists)", len(lists))
+	}
+}
+
+// loadLists loads the deny lists and enables the monitor mode of the monitored ones.
+func (s *Server) loadLists() ([]resolver.List, error) {
+	lists, err := s.lists.Load(s.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range lists {
+		lists[i].Monitor = slices.Contains(s.config.DenyListsMonitor, lists[i].Source)
+	}
+	return lists, nil
+}
+
+func (s *Server) handle(ctx context.Context, c net.Conn) {
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetKeepAlive(true)
+	}
+	raw := c
+	wc := newWatchConn(c)
+
+	c, header, err := http.Proxy(wc)
+	if err != nil {
+		s.Logger.Error(err)
+		return
+	}
+
+	//
+	// Authorization
+	//
+
+	var user string
+	if s.Authenticator != nil {
+		const payload = "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"Access to internal site\"\r\n\r\n"
+
+		var password string
+		var ok bool
+		user, password, ok = header.ProxyBasicAuth()
+		if !ok {
+			s.Logger.Info(header.String())
+			s.Logger.Error("no autorization provided")
+			c.Write([]byte(payload))
+			return
+		}
+		if !s.Authenticator(user, password) {
+			s.Logger.Info(header.String())
+			s.Logger.Error("invalid autorization provided")
+			c.Write([]byte(payload))
+			return
+		}
+	}
+
+	//
+	// Restrictions and deny check
+	//
+
+	req := Request{
+		User:   user,
+		Method: header.Method,
+		Host:   header.Domain(),
+		Port:   header.Port(),
+		Header: header.Header,
+	}
+	if header.Method != "CONNECT" {
+		req.URL = header.URL()
+	}
+
+	// The resolution and the connection to the remote are cancelled when the client disconnects
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := wc.watch(cancel)
+	defer stop()
+
+	result, err := s.Check(ctx, req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return // Client gone
+		}
+		s.Logger.Info(header.String())
+		s.Logger.Warn(err)
+		forbidden(c, err)
+		return
+	}
+
+	//
+	// TLS interception
+	//
+
+	if header.Method == "CONNECT" && s.interceptor != nil && s.interceptor.Match(result.Name) {
+		// The intercepted requests are relayed by the interceptor
+		stop()
+		c.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+		s.intercept(ctx, c, header, user, result.Name)
+		return
+	}
+
+	//
+	// TCP pipeline
+	//
+
+	rc, err := s.Dialer(resolver.WithHost(ctx, result.Name), "tcp", net.JoinHostPort(result.IP.String(), header.Port()))
+	stop()
+	if err != nil {
+		if ctx.Err() != nil {
+			return // Client gone
+		}
+		if errors.Is(err, resolver.ErrHostRejected) {
+			// Rejected by the verification of the dialed address
+			s.Logger.Info(header.String())
+			s.Logger.Warn(err)
+			forbidden(c, err)
+			return
+		}
+		if !tcp.IsIgnorableError(err) {
+			s.Logger.WithError(err).Error("failed to connect to remote")
+		}
+		return
+	}
+
+	if header.Method == "CONNECT" {
+		// Once connected successfully, return OK
+		c.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+
+		if s.config.SNIInspection != "" {
+			var ok bool
+			c, ok = s.inspectSNI(ctx, c, header)
+			if !ok {
+				rc.Close()
+				tcp.Reset(raw)
+				return
+			}
+		}
+	}
+
+	pipe, err := tcp.NewPipe(c, rc)
+	if err != nil {
+		rc.Close()
+		if !tcp.IsIgnorableError(err) {
+			s.Logger.WithError(err).Error("failed to establish pipe")
+		}
+		return
+	}
+	defer pipe.Close()
+
+	s.Logger.WithFields(logger.M{
+		"local":  fmt.Sprintf("%s/%s", pipe.LocalConn().LocalAddr(), pipe.LocalConn().RemoteAddr()),
+		"remote": fmt.Sprintf("%s/%s", pipe.RemoteConn().LocalAddr(), pipe.RemoteConn().RemoteAddr()),
+	}).Infof("%s %s", header.Method, net.JoinHostPort(result.Name, header.Port()))
+
+	err = pipe.Relay()
+	if err != nil && !tcp.IsIgnorableError(err) {
+		s.Logger.WithError(err).Error("pipe failure")
+	}
+	s.Logger.WithFields(relayFields(pipe.Stats())).Debugf("closed %s %s", header.Method, net.JoinHostPort(result.Name, header.Port()))
+}
+
+func (s *Server) filterURL(ctx context.Context, req resolver.URLRequest) error {
+	if f, ok := s.Resolver.(URLFilter); ok {
+		return f.FilterURL(ctx, req)
+	}
+	return nil
+}
+
+// relayFields returns the log fields of the statistics of a relay.
+func relayFields(stats tcp.Stats) logger.M {
+	return logger.M{
+		"up":         stats.Up,
+		"down":       stats.Down,
+		"duration":   stats.Duration(),
+		"first_byte": stats.FirstByte,
+		"reason":     stats.Reason,
+	}
+}
+
+// forbidden responds 403 to the client.
+// The rule rejecting the request is reported in the response when err is a resolver.RejectedError.
+func forbidden(c net.Conn, err error) {
+	var rejected *resolver.RejectedError
+	if !errors.As(err, &rejected) {
+		c.Write([]byte("HTTP/1.1 403 Forbidden\r\n\r\n"))
+		return
+	}
+
+	var rule string
+	if rejected.Rule != "" {
+		rule = fmt.Sprintf("%s: %s\r\n", RuleHeader, rejected.Rule)
+	}
+
+	body := rejected.Error() + "\n"
+	fmt.Fprintf(c, "HTTP/1.1 403 Forbidden\r\nContent-Type: text/plain\r\nContent-Length: %d\r\n%sConnection: close\r\n\r\n%s",
+		len(body), rule, body)
+}
+
+func (s *Server) filterIP(ctx context.Context, ip net.IP) error {
+	if f, ok := s.Resolver.(IPFilter); ok {
+		return f.FilterIP(ctx, ip)
+	}
+	return nil
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closed
+}
+
+func (s *Server) track(l net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(l net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l.Close()
+	delete(s.listeners, l)
+}
+
+func (s *Server) trackConn(c net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	s.conns[c] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *Server) untrackConn(c net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	return c
+	delete(s.conns, c)
+	s.wg.Done()
 }
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdouchement/ergo/resolver"
+	"github.com/mdouchement/ergo/tcp"
+	"github.com/miekg/dns"
+)
+
+// blockingUpstream is a name server answering only when the query is cancelled.
+type blockingUpstream struct {
+	started   chan struct{}
+	cancelled chan struct{}
+}
+
+func (u *blockingUpstream) Exchange(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	select {
+	case u.started <- struct{}{}:
+	default:
+	}
+
+	<-ctx.Done()
+	select {
+	case u.cancelled <- struct{}{}:
+	default:
+	}
+	return nil, ctx.Err()
+}
+
+func (u *blockingUpstream) String() string {
+	return "blocking"
+}
+
+func TestClientDisconnectCancelsResolution(t *testing.T) {
+	srv, err := New(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &blockingUpstream{started: make(chan struct{}, 1), cancelled: make(chan struct{}, 1)}
+	srv.Resolver = resolver.Chain(resolver.NewUpstreamResolver(upstream), resolver.Normalize)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	for _, request := range []string{
+		"CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n",
+		"GET http://example.org/ HTTP/1.1\r\nHost: example.org\r\n\r\n",
+	} {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = c.Write([]byte(request)); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-upstream.started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the resolution has not started")
+		}
+
+		tcp.Reset(c)
+
+		select {
+		case <-upstream.cancelled:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q: the upstream exchange is not cancelled when the client disconnects", request)
+		}
+	}
+}
+
+func TestClientHalfClose(t *testing.T) {
+	backend := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		io.WriteString(w, "hello "+r.Host)
+	}))
+	defer backend.Close()
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+
+	srv, err := New(Config{Hosts: map[string]IPs{"backend.test": {"127.0.0.1"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	request := "GET http://backend.test:" + port + "/ HTTP/1.0\r\nHost: backend.test:" + port + "\r\n\r\n"
+	if _, err = c.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	c.(*net.TCPConn).CloseWrite() // Nothing more to send, the response is still expected
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	response, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(response), "HTTP/1.0 200 OK") || !strings.HasSuffix(string(response), "hello backend.test:"+port) {
+		t.Fatalf("got response %q, expected the one of the backend", response)
+	}
+}
+
+func TestWatchConnKeepsReceivedData(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	var cancelled bool
+	wc := newWatchConn(server)
+	stop := wc.watch(func() { cancelled = true })
+
+	go client.Write([]byte("early data"))
+	time.Sleep(50 * time.Millisecond)
+	stop()
+
+	if cancelled {
+		t.Fatal("cancelled while the client is connected")
+	}
+
+	p := make([]byte, 64)
+	n, err := wc.Read(p)
+	if err != nil || string(p[:n]) != "early data" {
+		t.Fatalf("Read() = %q, %v, expected the data received while watching", p[:n], err)
+	}
+}
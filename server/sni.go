@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/mdouchement/ergo/http"
+	"github.com/mdouchement/ergo/resolver"
+	"github.com/mdouchement/ergo/sniff"
+	"github.com/mdouchement/logger"
+	"github.com/pkg/errors"
+)
+
+// SNI inspection modes.
+const (
+	// SNIInspectionLog logs the TLS server name of the tunnels and its mismatches with the CONNECT host.
+	SNIInspectionLog = "log"
+	// SNIInspectionEnforce resets the tunnels whose TLS server name is rejected by the deny list.
+	SNIInspectionEnforce = "enforce"
+	// SNIInspectionStrict resets the tunnels whose TLS server name is rejected by the deny list,
+	// mismatches the CONNECT host or that do not start with a TLS ClientHello.
+	SNIInspectionStrict = "strict"
+)
+
+// inspectSNI peeks the ClientHello sent through the CONNECT tunnel and checks its server name.
+// It returns the connection to relay and false if the tunnel must be reset.
+func (s *Server) inspectSNI(ctx context.Context, c net.Conn, header http.Header) (net.Conn, bool) {
+	mode := s.config.SNIInspection
+	sc := sniff.NewConn(c)
+
+	log := s.Logger.WithField("connect", header.Host())
+
+	sc.SetReadDeadline(time.Now().Add(SniffTimeout))
+	defer sc.SetReadDeadline(time.Time{})
+
+	if !sniff.IsTLS(sc) {
+		log.Warn("[sni] tunnel does not start with a TLS handshake")
+		return sc, mode != SNIInspectionStrict
+	}
+
+	hello, err := sniff.TLS(sc)
+	if err != nil {
+		log.WithError(err).Warn("[sni] could not parse ClientHello")
+		return sc, mode != SNIInspectionStrict
+	}
+
+	log = log.WithFields(logger.M{
+		"sni":  hello.ServerName,
+		"alpn": strings.Join(hello.ALPN, ","),
+	})
+	log.Debug("[sni] ClientHello")
+
+	if hello.ServerName == "" {
+		log.Warn("[sni] no server name provided")
+		return sc, mode != SNIInspectionStrict
+	}
+
+	name, err := resolver.NormalizeHost(hello.ServerName)
+	if err != nil {
+		log.WithError(err).Warn("[sni] invalid server name")
+		return sc, mode == SNIInspectionLog
+	}
+	domain, _ := resolver.NormalizeHost(header.Domain())
+
+	mismatch := name != domain
+	if mismatch {
+		log.Warn("[sni] server name mismatches the CONNECT host")
+	}
+
+	_, err = s.Resolver.Resolve(ctx, name)
+	if errors.Is(err, resolver.ErrHostRejected) {
+		log.Warn(err)
+		return sc, mode == SNIInspectionLog
+	}
+
+	return sc, !mismatch || mode != SNIInspectionStrict
+}
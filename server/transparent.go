@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/mdouchement/ergo/resolver"
+	"github.com/mdouchement/ergo/sniff"
+	"github.com/mdouchement/ergo/tcp"
+	"github.com/mdouchement/logger"
+	"github.com/pkg/errors"
+)
+
+// SniffTimeout is the maximum duration to wait for the first bytes of a transparent connection.
+const SniffTimeout = 5 * time.Second
+
+func (s *Server) handleTransparent(ctx context.Context, c net.Conn) {
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetKeepAlive(true)
+	}
+
+	dst, err := tcp.OriginalDestination(c)
+	if err != nil {
+		s.Logger.WithError(err).Error("transparent")
+		return
+	}
+	if dst.String() == c.LocalAddr().String() {
+		// Direct connection to the transparent listener, it would loop on itself.
+		s.Logger.Errorf("transparent: no original destination for %s", c.RemoteAddr())
+		return
+	}
+
+	//
+	// Domain name sniffing
+	//
+
+	sc := sniff.NewConn(c)
+	req := s.sniff(sc)
+
+	//
+	// Restrictions and deny check
+	//
+
+	result, err := s.checkTransparent(ctx, dst, req)
+	if err != nil {
+		s.Logger.WithField("transparent", dst.String()).Warn(err)
+		if req.Method != "TLS" && req.Method != "" {
+			forbidden(c, err)
+		}
+		return
+	}
+	ctx = resolver.WithHost(ctx, result.Name)
+
+	//
+	// TCP pipeline
+	//
+
+	rc, err := s.Dialer(ctx, "tcp", dst.String())
+	if err != nil {
+		if errors.Is(err, resolver.ErrHostRejected) {
+			s.Logger.WithField("transparent", dst.String()).Warn(err)
+			if req.Method != "TLS" && req.Method != "" {
+				forbidden(c, err)
+			}
+			return
+		}
+		if !tcp.IsIgnorableError(err) {
+			s.Logger.WithError(err).Error("failed to connect to remote")
+		}
+		return
+	}
+
+	pipe, err := tcp.NewPipe(sc, rc)
+	if err != nil {
+		rc.Close()
+		if !tcp.IsIgnorableError(err) {
+			s.Logger.WithError(err).Error("failed to establish pipe")
+		}
+		return
+	}
+	defer pipe.Close()
+
+	s.Logger.WithFields(logger.M{
+		"local":  fmt.Sprintf("%s/%s", pipe.LocalConn().LocalAddr(), pipe.LocalConn().RemoteAddr()),
+		"remote": fmt.Sprintf("%s/%s", pipe.RemoteConn().LocalAddr(), pipe.RemoteConn().RemoteAddr()),
+	}).Infof("[transparent] %s %s (%s)", req.Method, dst, req.Host)
+
+	err = pipe.Relay()
+	if err != nil && !tcp.IsIgnorableError(err) {
+		s.Logger.WithError(err).Error("pipe failure")
+	}
+	s.Logger.WithFields(relayFields(pipe.Stats())).Debugf("[transparent] closed %s %s (%s)", req.Method, dst, req.Host)
+}
+
+// checkTransparent checks the sniffed request of a connection redirected to dst and returns the resolution
+// of its host. The TLS and unknown protocols are checked as CONNECT tunnels, the connections without sniffed host
+// by their destination IP.
+// The destination must be one of the IPs of the sniffed host, otherwise the rules of an allowed host would apply
+// to any destination.
+func (s *Server) checkTransparent(ctx context.Context, dst *net.TCPAddr, req Request) (*resolver.Result, error) {
+	req.Port = strconv.Itoa(dst.Port)
+	if req.Method == "TLS" || req.Method == "" {
+		req.Method = "CONNECT"
+	}
+	if req.Host == "" {
+		req.Host = dst.IP.String()
+		req.URL = ""
+	}
+
+	result, err := s.Check(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if !slices.ContainsFunc(result.IPs, dst.IP.Equal) {
+		return nil, &resolver.RejectedError{Kind: "misdirected", Target: result.Name + " on " + dst.IP.String()}
+	}
+
+	return result, s.filterIP(resolver.WithHost(ctx, result.Name), dst.IP)
+}
+
+// sniff returns the request found in the first bytes of the connection, its method is TLS for a TLS connection.
+// The host is the TLS server name or the Host header, it is empty when it cannot be sniffed.
+func (s *Server) sniff(c *sniff.Conn) Request {
+	c.SetReadDeadline(time.Now().Add(SniffTimeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	if sniff.IsTLS(c) {
+		hello, err := sniff.TLS(c)
+		if err != nil {
+			s.Logger.WithError(err).Debug("transparent: could not sniff SNI")
+			return Request{Method: "TLS"}
+		}
+		return Request{Method: "TLS", Host: hello.ServerName}
+	}
+
+	header, err := sniff.HTTP(c)
+	if err != nil {
+		s.Logger.WithError(err).Debug("transparent: could not sniff Host header")
+		return Request{}
+	}
+
+	req := Request{Method: header.Method, Host: header.Domain(), Header: header.Header}
+	if header.Method != "CONNECT" {
+		req.URL = header.URL()
+	}
+	return req
+}
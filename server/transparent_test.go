@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/mdouchement/ergo/resolver"
+	"github.com/mdouchement/ergo/sniff"
+)
+
+func TestSniff(t *testing.T) {
+	srv, err := New(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		send     func(c net.Conn)
+		expected Request
+	}{
+		{
+			name: "tls",
+			send: func(c net.Conn) {
+				tls.Client(c, &tls.Config{ServerName: "example.test"}).Handshake()
+			},
+			expected: Request{Method: "TLS", Host: "example.test"},
+		},
+		{
+			name: "tls without server name",
+			send: func(c net.Conn) {
+				tls.Client(c, &tls.Config{InsecureSkipVerify: true}).Handshake()
+			},
+			expected: Request{Method: "TLS"},
+		},
+		{
+			name: "http",
+			send: func(c net.Conn) {
+				c.Write([]byte("POST /upload?id=1 HTTP/1.1\r\nHost: Example.test:8080\r\n\r\nbody"))
+			},
+			expected: Request{Method: "POST", Host: "Example.test", URL: "http://Example.test:8080/upload?id=1"},
+		},
+		{
+			name: "unknown",
+			send: func(c net.Conn) {
+				c.Write([]byte("SSH-2.0-OpenSSH_9.6\r\n"))
+			},
+			expected: Request{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			go func() {
+				defer client.Close()
+				test.send(client)
+			}()
+
+			req := srv.sniff(sniff.NewConn(server))
+			req.Header = nil
+			expect(t, "request", req, test.expected)
+		})
+	}
+}
+
+func TestCheckTransparent(t *testing.T) {
+	srv, err := New(Config{
+		Config: resolver.Config{
+			DenyList:        []string{"||denied.test^", "||allowed.test/ads/*"},
+			BlockedNetworks: []string{"198.51.100.0/24"},
+		},
+		Hosts: map[string]IPs{"allowed.test": {"192.0.2.1"}, "denied.test": {"192.0.2.2"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		req  Request
+		dst  string
+		kind string // Allowed when empty
+	}{
+		{req: Request{Method: "TLS", Host: "allowed.test"}, dst: "192.0.2.1:443"},
+		{req: Request{Method: "TLS", Host: "ALLOWED.test."}, dst: "192.0.2.1:8443"},
+		{req: Request{Method: "TLS"}, dst: "192.0.2.1:443"},
+		{req: Request{Method: "TLS"}, dst: "203.0.113.1:443"},
+		{req: Request{}, dst: "203.0.113.1:443"},
+		{req: Request{Method: "GET", Host: "allowed.test", URL: "http://allowed.test/"}, dst: "192.0.2.1:80"},
+		// An allowed server name sent to another destination
+		{req: Request{Method: "TLS", Host: "allowed.test"}, dst: "203.0.113.1:443", kind: "misdirected"},
+		{req: Request{Method: "GET", Host: "allowed.test", URL: "http://allowed.test/"}, dst: "192.0.2.2:80", kind: "misdirected"},
+		// Deny rules
+		{req: Request{Method: "TLS", Host: "denied.test"}, dst: "192.0.2.2:443", kind: "domain"},
+		{req: Request{Method: "GET", Host: "allowed.test", URL: "http://allowed.test/ads/x"}, dst: "192.0.2.1:80", kind: "url"},
+		{req: Request{Method: "TLS"}, dst: "198.51.100.7:443", kind: "network"},
+		// Restrictions
+		{req: Request{Method: "TLS", Host: "allowed.test"}, dst: "192.0.2.1:22", kind: "port"},
+		{req: Request{}, dst: "203.0.113.1:25", kind: "port"},
+		{req: Request{Method: "GET", Host: "allowed.test", URL: "http://allowed.test:443/"}, dst: "192.0.2.1:443", kind: "port"},
+	}
+
+	for _, test := range tests {
+		dst, err := net.ResolveTCPAddr("tcp", test.dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = srv.checkTransparent(context.Background(), dst, test.req)
+		if test.kind == "" {
+			if err != nil {
+				t.Errorf("%s %q to %s: %v", test.req.Method, test.req.Host, test.dst, err)
+			}
+			continue
+		}
+
+		var rejected *resolver.RejectedError
+		if !errors.As(err, &rejected) || rejected.Kind != test.kind {
+			t.Errorf("%s %q to %s: got %v, expected a %s rejection", test.req.Method, test.req.Host, test.dst, err, test.kind)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// watchLimit is the maximum number of bytes buffered while a connection is watched, the watch stops beyond.
+const watchLimit = 64 * 1024
+
+// A watchConn is a client connection watched for a disconnection while it is not read by the server
+// (e.g. during the resolution of the destination).
+// The data received while watching are returned by the next reads.
+type watchConn struct {
+	net.Conn
+	buf []byte
+	err error
+}
+
+func newWatchConn(c net.Conn) *watchConn {
+	return &watchConn{Conn: c}
+}
+
+// watch calls cancel when the client connection is reset or fails, until the returned stop function is called.
+// The watch stops at EOF without calling cancel as the client may only have closed its write side
+// (e.g. HTTP/1.0 clients), the request is then still served.
+// The connection must not be read before stop is called.
+func (c *watchConn) watch(cancel context.CancelFunc) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		p := make([]byte, 4096)
+		for len(c.buf) < watchLimit {
+			n, err := c.Conn.Read(p)
+			c.buf = append(c.buf, p[:n]...)
+			if err != nil {
+				if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) && !isTimeout(err) {
+					c.err = err
+					cancel()
+				}
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.Conn.SetReadDeadline(time.Unix(1, 0)) // Wakes up the watching read
+			<-done
+			c.Conn.SetReadDeadline(time.Time{})
+		})
+	}
+}
+
+// Read reads the data received while watching before the data of the wrapped connection.
+func (c *watchConn) Read(p []byte) (int, error) {
+	if len(c.buf) > 0 {
+		n := copy(p, c.buf)
+		c.buf = c.buf[n:]
+		return n, nil
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(p)
+}
+
+// NetConn returns the wrapped connection, it can be read directly once WriteBuffered emptied the buffer.
+func (c *watchConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// WriteBuffered writes the data received while watching to w.
+func (c *watchConn) WriteBuffered(w io.Writer) (int64, error) {
+	n, err := w.Write(c.buf)
+	c.buf = c.buf[n:]
+	return int64(n), err
+}
+
+func isTimeout(err error) bool {
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
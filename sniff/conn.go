@@ -0,0 +1,53 @@
+package sniff
+
+import (
+	"bufio"
+	"io"
+	"net"
+)
+
+// MaxSize is the maximum number of bytes that can be sniffed from a connection.
+// It is large enough to contain a whole TLS record.
+const MaxSize = 5 + 16384
+
+// A Conn is a net.Conn that can peek the incoming data without consuming it.
+type Conn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// NewConn returns a new sniffing connection.
+func NewConn(c net.Conn) *Conn {
+	return &Conn{
+		Conn: c,
+		r:    bufio.NewReaderSize(c, MaxSize),
+	}
+}
+
+// Peek returns the next n bytes without consuming them.
+func (c *Conn) Peek(n int) ([]byte, error) {
+	return c.r.Peek(n)
+}
+
+// Buffered returns the bytes already read from the connection but not yet consumed.
+func (c *Conn) Buffered() []byte {
+	p, _ := c.r.Peek(c.r.Buffered())
+	return p
+}
+
+// Read reads the sniffed data before the data of the wrapped connection.
+func (c *Conn) Read(p []byte) (n int, err error) {
+	return c.r.Read(p)
+}
+
+// WriteBuffered writes the bytes already read from the connection but not yet consumed to w.
+func (c *Conn) WriteBuffered(w io.Writer) (int64, error) {
+	n, err := w.Write(c.Buffered())
+	c.r.Discard(n)
+	return int64(n), err
+}
+
+// NetConn returns the wrapped connection, it can be read directly once WriteBuffered consumed the buffer.
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,29 @@
+package sniff
+
+import (
+	"bytes"
+
+	"github.com/mdouchement/ergo/http"
+	"github.com/pkg/errors"
+)
+
+// HTTP peeks the HTTP request header of the connection.
+func HTTP(c *Conn) (http.Header, error) {
+	n := 1
+	for {
+		p, err := c.Peek(n)
+		if err != nil {
+			return http.Header{}, errors.Wrap(err, "sniff http")
+		}
+
+		p = c.Buffered()
+		if bytes.Contains(p, []byte("\r\n\r\n")) {
+			return http.Parse(http.NewReader(bytes.NewReader(p)))
+		}
+		if len(p) >= MaxSize {
+			return http.Header{}, errors.New("sniff http: header too large")
+		}
+
+		n = len(p) + 1
+	}
+}
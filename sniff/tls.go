@@ -0,0 +1,84 @@
+package sniff
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const recordTypeHandshake = 0x16
+
+var errSniffed = errors.New("sniffed")
+
+// A ClientHello holds the details of a TLS ClientHello message.
+type ClientHello struct {
+	ServerName string
+	ALPN       []string
+}
+
+// IsTLS returns true if the connection starts with a TLS handshake record.
+func IsTLS(c *Conn) bool {
+	p, err := c.Peek(1)
+	return err == nil && p[0] == recordTypeHandshake
+}
+
+// TLS peeks the first TLS record of the connection and extracts the ClientHello details.
+func TLS(c *Conn) (*ClientHello, error) {
+	header, err := c.Peek(5)
+	if err != nil {
+		return nil, errors.Wrap(err, "sniff tls")
+	}
+	if header[0] != recordTypeHandshake {
+		return nil, errors.New("sniff tls: not a handshake record")
+	}
+
+	size := 5 + (int(header[3])<<8 | int(header[4]))
+	if size > MaxSize {
+		return nil, errors.New("sniff tls: record too large")
+	}
+
+	record, err := c.Peek(size)
+	if err != nil {
+		return nil, errors.Wrap(err, "sniff tls")
+	}
+
+	return ParseClientHello(record)
+}
+
+// ParseClientHello extracts the ClientHello details from the given TLS record.
+func ParseClientHello(record []byte) (*ClientHello, error) {
+	var hello *ClientHello
+
+	err := tls.Server(readOnlyConn{r: bytes.NewReader(record)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = &ClientHello{
+				ServerName: info.ServerName,
+				ALPN:       append([]string(nil), info.SupportedProtos...),
+			}
+			return nil, errSniffed
+		},
+	}).Handshake()
+	if hello == nil {
+		return nil, errors.Wrap(err, "sniff tls: invalid ClientHello")
+	}
+
+	return hello, nil
+}
+
+// readOnlyConn is a net.Conn that only reads from r and discards all writes.
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(_ time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(_ time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(_ time.Time) error { return nil }
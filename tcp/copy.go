@@ -0,0 +1,64 @@
+package tcp
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// A BufferedConn is a connection reading the connection it wraps through a buffer (e.g. http.BufferConn).
+// Its writes must go straight to the wrapped connection.
+// The relays write the buffered bytes then use the wrapped connection directly, so the raw TCP connections
+// can be spliced.
+type BufferedConn interface {
+	net.Conn
+	// NetConn returns the wrapped connection.
+	NetConn() net.Conn
+	// WriteBuffered writes the buffered bytes to w and empties the buffer.
+	WriteBuffered(w io.Writer) (int64, error)
+}
+
+// bufferSize is the size of the buffers of the copies that cannot be spliced.
+const bufferSize = 32 * 1024
+
+var buffers = sync.Pool{
+	New: func() any {
+		b := make([]byte, bufferSize)
+		return &b
+	},
+}
+
+// copyConn copies from src to dst until EOF, counting the bytes with m.
+// The copy is spliced when both connections are TCP connections once unwrapped (Linux only),
+// otherwise it uses a pooled buffer.
+func copyConn(dst, src net.Conn, m *meter) error {
+	for {
+		b, ok := dst.(BufferedConn)
+		if !ok {
+			break
+		}
+		dst = b.NetConn()
+	}
+
+	for {
+		b, ok := src.(BufferedConn)
+		if !ok {
+			break
+		}
+		if _, err := b.WriteBuffered(&countWriter{w: dst, m: m}); err != nil {
+			return err
+		}
+		src = b.NetConn()
+	}
+
+	if ok, err := splice(dst, src, m); ok {
+		return err
+	}
+
+	buf := buffers.Get().(*[]byte)
+	defer buffers.Put(buf)
+
+	// The reader is hidden behind a struct so io.CopyBuffer does not bypass the buffer with WriterTo.
+	_, err := io.CopyBuffer(&countWriter{w: dst, m: m}, struct{ io.Reader }{src}, *buf)
+	return err
+}
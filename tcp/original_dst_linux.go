@@ -0,0 +1,81 @@
+//go:build linux
+
+package tcp
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// soOriginalDst is the SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST option from netfilter.
+const soOriginalDst = 80
+
+// OriginalDestination returns the destination of a connection redirected by netfilter
+// (e.g. iptables REDIRECT rule) using the SO_ORIGINAL_DST socket option.
+func OriginalDestination(c net.Conn) (*net.TCPAddr, error) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil, errors.Errorf("original destination: unsupported connection %T", c)
+	}
+
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return nil, errors.Wrap(err, "original destination")
+	}
+
+	ipv6 := false
+	if addr, ok := tc.LocalAddr().(*net.TCPAddr); ok {
+		ipv6 = addr.IP.To4() == nil
+	}
+
+	var addr *net.TCPAddr
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if ipv6 {
+			// IPv6MTUInfo starts with a sockaddr_in6 structure.
+			var info *unix.IPv6MTUInfo
+			info, serr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, soOriginalDst)
+			if serr != nil {
+				return
+			}
+
+			addr = &net.TCPAddr{
+				IP:   net.IP(info.Addr.Addr[:]),
+				Port: int(ntohs(info.Addr.Port)),
+			}
+			return
+		}
+
+		// IPv6Mreq is large enough to contain a sockaddr_in structure.
+		var mreq *unix.IPv6Mreq
+		mreq, serr = unix.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+		if serr != nil {
+			return
+		}
+
+		// struct sockaddr_in { sa_family_t sin_family; in_port_t sin_port; struct in_addr sin_addr; }
+		raw := mreq.Multiaddr
+		addr = &net.TCPAddr{
+			IP:   net.IPv4(raw[4], raw[5], raw[6], raw[7]),
+			Port: int(raw[2])<<8 | int(raw[3]),
+		}
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "original destination")
+	}
+	if serr != nil {
+		return nil, errors.Wrap(serr, "original destination")
+	}
+
+	return addr, nil
+}
+
+// ntohs converts a port from network byte order.
+func ntohs(port uint16) uint16 {
+	b := (*[2]byte)(unsafe.Pointer(&port))
+	return uint16(b[0])<<8 | uint16(b[1])
+}
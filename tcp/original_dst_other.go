@@ -0,0 +1,15 @@
+//go:build !linux
+
+package tcp
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// OriginalDestination returns the destination of a connection redirected by netfilter.
+// It is only supported on Linux.
+func OriginalDestination(c net.Conn) (*net.TCPAddr, error) {
+	return nil, errors.New("original destination: only supported on linux")
+}
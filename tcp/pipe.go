@@ -6,9 +6,12 @@ import (
 	"github.com/pkg/errors"
 )
 
+// A Pipe relays a local connection to a remote one.
+// Its statistics are available during the relay and after it ends.
 type Pipe struct {
-	rc net.Conn
-	c  net.Conn
+	rc    net.Conn
+	c     net.Conn
+	stats counters
 }
 
 func NewPipeTCP(c net.Conn, remote string) (*Pipe, error) {
@@ -29,10 +32,15 @@ func NewPipe(c, rc net.Conn) (*Pipe, error) {
 }
 
 func (s *Pipe) Relay() error {
-	err := Relay(s.c, s.rc)
+	err := relay(s.c, s.rc, &s.stats)
 	return errors.Wrap(err, "pipe-relay")
 }
 
+// Stats returns the statistics of the relay, it is safe to call during the relay.
+func (s *Pipe) Stats() Stats {
+	return s.stats.stats()
+}
+
 func (s *Pipe) LocalConn() net.Conn {
 	return s.c
 }
@@ -1,7 +1,6 @@
 package tcp
 
 import (
-	"io"
 	"net"
 	"strings"
 	"sync"
@@ -10,13 +9,26 @@ import (
 	"github.com/pkg/errors"
 )
 
-// Relay copies between local and remote bidirectionally. Returns number of
-// bytes copied from remote to local, from local to remote, and any error occurred.
+// Relay copies between local and remote bidirectionally. Returns any error occurred.
 // Borrowed from: https://github.com/shadowsocks/go-shadowsocks2
 func Relay(local, remote net.Conn) error {
+	var c counters
+	return relay(local, remote, &c)
+}
+
+// RelayStats is Relay returning the statistics of the relay (e.g. the number of bytes copied from local to remote
+// and from remote to local).
+func RelayStats(local, remote net.Conn) (Stats, error) {
+	var c counters
+	err := relay(local, remote, &c)
+	return c.stats(), err
+}
+
+func relay(local, remote net.Conn, c *counters) error {
 	var err, err1 error
 	var wg sync.WaitGroup
 	delay := time.Second
+	start := c.begin()
 
 	// remote = Dumper(remote, true)
 
@@ -24,14 +36,17 @@ func Relay(local, remote net.Conn) error {
 	go func() {
 		defer wg.Done()
 
-		_, err1 = io.Copy(remote, local)
+		err1 = copyConn(remote, local, &meter{n: &c.up})
+		c.done(closeReason(err1, CloseClientEOF))
 		remote.SetDeadline(time.Now().Add(delay)) // wake up the other goroutine blocking on remote
 	}()
 
-	_, err = io.Copy(local, remote)
+	err = copyConn(local, remote, &meter{n: &c.down, first: &c.firstByte, start: start})
+	c.done(closeReason(err, CloseRemoteEOF))
 	local.SetDeadline(time.Now().Add(delay)) // wake up the other goroutine blocking on local
 
 	wg.Wait()
+	c.finish()
 
 	if err1 != nil {
 		return err1
@@ -39,6 +54,14 @@ func Relay(local, remote net.Conn) error {
 	return err
 }
 
+// Reset closes the connection by sending a TCP RST to the peer, discarding any unsent data.
+func Reset(c net.Conn) error {
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	return c.Close()
+}
+
 // IsIgnorableError returns true if the net error is ignorable.
 func IsIgnorableError(err error) bool {
 	err = errors.Cause(err)
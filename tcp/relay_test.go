@@ -0,0 +1,258 @@
+package tcp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// A prefixConn is a BufferedConn that has read prefix ahead from its connection.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(p, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *prefixConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *prefixConn) WriteBuffered(w io.Writer) (int64, error) {
+	n, err := w.Write(c.prefix)
+	c.prefix = c.prefix[n:]
+	return int64(n), err
+}
+
+// plainConn hides the TCP connection so the relay falls back to the buffered copy.
+type plainConn struct {
+	net.Conn
+}
+
+func TestRelay(t *testing.T) {
+	upload := randomBytes(t, 200<<10)
+	download := randomBytes(t, 256<<10)
+	prefix := []byte("CONNECT example.com:443 HTTP/1.1\r\n\r\n")
+
+	tests := []struct {
+		name   string
+		prefix []byte
+		wrap   func(c net.Conn, prefix []byte) net.Conn
+	}{
+		{name: "splice", wrap: func(c net.Conn, _ []byte) net.Conn { return c }},
+		{name: "copy", wrap: func(c net.Conn, _ []byte) net.Conn { return plainConn{c} }},
+		{name: "buffered", prefix: prefix, wrap: func(c net.Conn, prefix []byte) net.Conn {
+			return &prefixConn{Conn: c, prefix: prefix}
+		}},
+		{name: "buffered copy", prefix: prefix, wrap: func(c net.Conn, prefix []byte) net.Conn {
+			return &prefixConn{Conn: plainConn{c}, prefix: prefix}
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, local := tcpPair(t)
+			remote, server := tcpPair(t)
+			defer client.Close()
+
+			// Small socket buffers and uneven reads and writes so the copies are partial.
+			client.(*net.TCPConn).SetReadBuffer(16 << 10)
+			local.(*net.TCPConn).SetWriteBuffer(16 << 10)
+			server.(*net.TCPConn).SetReadBuffer(16 << 10)
+			remote.(*net.TCPConn).SetWriteBuffer(16 << 10)
+
+			errs := make(chan error, 2)
+			go func() {
+				defer server.Close()
+
+				received := make([]byte, len(test.prefix)+len(upload))
+				if _, err := io.ReadFull(server, received); err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(received, append(test.prefix, upload...)) {
+					errs <- errors.New("server: corrupted upload")
+					return
+				}
+				errs <- writeChunks(server, download)
+			}()
+
+			received := make(chan []byte, 1)
+			go func() {
+				if err := writeChunks(client, upload); err != nil {
+					errs <- err
+					return
+				}
+				client.(*net.TCPConn).CloseWrite() // The download goes on after the half-close
+
+				var buf bytes.Buffer
+				p := make([]byte, 4000)
+				for {
+					n, err := client.Read(p[:1+buf.Len()%len(p)])
+					buf.Write(p[:n])
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						errs <- err
+						return
+					}
+				}
+				received <- buf.Bytes()
+				errs <- nil
+			}()
+
+			pipe, _ := NewPipe(test.wrap(local, test.prefix), test.wrap(remote, nil))
+			err := pipe.Relay()
+			pipe.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for range 2 {
+				if err := <-errs; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if !bytes.Equal(<-received, download) {
+				t.Error("client: corrupted download")
+			}
+
+			stats := pipe.Stats()
+			if up := int64(len(test.prefix) + len(upload)); stats.Up != up {
+				t.Errorf("got %d bytes up, expected %d", stats.Up, up)
+			}
+			if down := int64(len(download)); stats.Down != down {
+				t.Errorf("got %d bytes down, expected %d", stats.Down, down)
+			}
+			if stats.Reason != CloseClientEOF {
+				t.Errorf("got reason %q, expected %q", stats.Reason, CloseClientEOF)
+			}
+			if stats.FirstByte <= 0 || stats.FirstByte > stats.Duration() {
+				t.Errorf("got first byte after %v, expected within %v", stats.FirstByte, stats.Duration())
+			}
+		})
+	}
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	p := make([]byte, n)
+	if _, err := rand.Read(p); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// writeChunks writes p with writes of uneven sizes.
+func writeChunks(w io.Writer, p []byte) error {
+	for size := 1; len(p) > 0; size = size*7%65521 + 1 {
+		n := min(size, len(p))
+		if _, err := w.Write(p[:n]); err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+func BenchmarkRelay(b *testing.B) {
+	b.Run("splice", func(b *testing.B) {
+		benchmarkRelay(b, RelayStats, func(c net.Conn) net.Conn { return c })
+	})
+	b.Run("copy", func(b *testing.B) {
+		benchmarkRelay(b, RelayStats, func(c net.Conn) net.Conn { return plainConn{c} })
+	})
+	// Baseline: io.Copy on the raw TCP connections, spliced by net.TCPConn.ReadFrom without byte counting
+	// during the copy.
+	b.Run("io.Copy", func(b *testing.B) {
+		benchmarkRelay(b, copyRelay, func(c net.Conn) net.Conn { return c })
+	})
+}
+
+func copyRelay(local, remote net.Conn) (stats Stats, err error) {
+	var err1 error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		stats.Up, err1 = io.Copy(remote, local)
+		remote.(*net.TCPConn).CloseWrite()
+	}()
+
+	stats.Down, err = io.Copy(local, remote)
+	local.(*net.TCPConn).CloseWrite()
+	<-done
+
+	if err1 != nil {
+		return stats, err1
+	}
+	return stats, err
+}
+
+// benchmarkRelay relays a download from a server to a client, as for an artifact download.
+func benchmarkRelay(b *testing.B, relay func(local, remote net.Conn) (Stats, error), wrap func(net.Conn) net.Conn) {
+	const size = 16 << 20
+	payload := make([]byte, 256<<10)
+	buf := make([]byte, 1<<20) // Large reads so the client is not the bottleneck
+
+	b.SetBytes(size)
+	b.ReportAllocs()
+	for b.Loop() {
+		client, local := tcpPair(b)
+		remote, server := tcpPair(b)
+
+		go func() {
+			defer server.Close()
+			for range size / len(payload) {
+				if _, err := server.Write(payload); err != nil {
+					return
+				}
+			}
+		}()
+		client.(*net.TCPConn).CloseWrite() // Nothing to upload
+		done := make(chan int64)
+		go func() {
+			n, _ := io.CopyBuffer(io.Discard, struct{ io.Reader }{client}, buf)
+			done <- n
+		}()
+
+		stats, err := relay(wrap(local), wrap(remote))
+		local.Close()
+		remote.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if n := <-done; stats.Up != 0 || stats.Down != size || n != size {
+			b.Fatalf("relayed %d/%d bytes, received %d bytes, expected 0/%d", stats.Up, stats.Down, n, size)
+		}
+		client.Close()
+	}
+}
+
+// tcpPair returns the two ends of a loopback TCP connection.
+func tcpPair(b testing.TB) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+	return c, s
+}
@@ -0,0 +1,100 @@
+//go:build linux
+
+package tcp
+
+import (
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// spliceSize is the maximum number of bytes moved by a splice(2) call, it is the capacity requested for the pipe.
+const spliceSize = 1 << 20
+
+// splice copies from src to dst until EOF with splice(2) through a pipe, counting the bytes with m.
+// The data are moved by the kernel without being copied to the user space.
+// io.Copy also splices between TCP connections (net.TCPConn.ReadFrom) but it counts the bytes only once the copy
+// ends, this loop keeps the statistics of the relays up to date and is faster thanks to its larger pipe
+// (see BenchmarkRelay).
+// It returns false when the connections are not both TCP connections or the kernel does not support it,
+// the copy must then be done by the caller.
+func splice(dst, src net.Conn, m *meter) (bool, error) {
+	dtc, ok := dst.(*net.TCPConn)
+	if !ok {
+		return false, nil
+	}
+	stc, ok := src.(*net.TCPConn)
+	if !ok {
+		return false, nil
+	}
+
+	rdst, err := dtc.SyscallConn()
+	if err != nil {
+		return false, nil
+	}
+	rsrc, err := stc.SyscallConn()
+	if err != nil {
+		return false, nil
+	}
+
+	var p [2]int
+	if err = unix.Pipe2(p[:], unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+		return false, nil
+	}
+	defer unix.Close(p[0])
+	defer unix.Close(p[1])
+
+	// The default capacity of a pipe is 64KiB, a larger one needs fewer system calls (best effort as it is limited
+	// by /proc/sys/fs/pipe-max-size).
+	size, err := unix.FcntlInt(uintptr(p[1]), unix.F_SETPIPE_SZ, spliceSize)
+	if err != nil {
+		size = 64 * 1024
+	}
+
+	var spliced bool
+	for {
+		// Socket to pipe
+		var n int64
+		var serr error
+		err = rsrc.Read(func(fd uintptr) bool {
+			n, serr = unix.Splice(int(fd), nil, p[1], nil, size, unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+			return serr != unix.EAGAIN
+		})
+		if err != nil {
+			return true, err
+		}
+		if serr != nil {
+			if !spliced && (serr == unix.EINVAL || serr == unix.ENOSYS) {
+				return false, nil
+			}
+			return true, spliceError(stc, serr)
+		}
+		if n == 0 {
+			return true, nil // EOF
+		}
+		spliced = true
+
+		// Pipe to socket, the pipe is always drained so the next read cannot block on a full pipe
+		for n > 0 {
+			var w int64
+			err = rdst.Write(func(fd uintptr) bool {
+				w, serr = unix.Splice(p[0], nil, int(fd), nil, int(n), unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+				return serr != unix.EAGAIN
+			})
+			if err != nil {
+				return true, err
+			}
+			if serr != nil {
+				return true, spliceError(dtc, serr)
+			}
+
+			m.add(w)
+			n -= w
+		}
+	}
+}
+
+func spliceError(c *net.TCPConn, err error) error {
+	return &net.OpError{Op: "splice", Net: "tcp", Source: c.LocalAddr(), Addr: c.RemoteAddr(), Err: os.NewSyscallError("splice", err)}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package tcp
+
+import "net"
+
+// splice is only supported on Linux, it always returns false.
+func splice(dst, src net.Conn, m *meter) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,151 @@
+package tcp
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A CloseReason is the reason a relay ended.
+type CloseReason string
+
+const (
+	// CloseNone is the reason of a relay not ended yet.
+	CloseNone CloseReason = ""
+	// CloseClientEOF is the reason of a relay ended by the local side closing its connection.
+	CloseClientEOF CloseReason = "client EOF"
+	// CloseRemoteEOF is the reason of a relay ended by the remote side closing its connection.
+	CloseRemoteEOF CloseReason = "remote EOF"
+	// CloseTimeout is the reason of a relay ended by a deadline of one of the connections.
+	CloseTimeout CloseReason = "timeout"
+	// CloseError is the reason of a relay ended by an error of one of the connections.
+	CloseError CloseReason = "error"
+)
+
+// Stats holds the statistics of a relay.
+type Stats struct {
+	// Up is the number of bytes copied from local to remote.
+	Up int64
+	// Down is the number of bytes copied from remote to local.
+	Down int64
+	// Start is the time the relay started, zero when not started.
+	Start time.Time
+	// End is the time the relay ended, zero when not ended.
+	End time.Time
+	// FirstByte is the duration between the start and the first byte copied from remote to local,
+	// zero when no byte has been copied yet.
+	FirstByte time.Duration
+	// Reason is the reason the relay ended.
+	Reason CloseReason
+}
+
+// Duration returns the duration of the relay, up to now when not ended.
+func (s Stats) Duration() time.Duration {
+	if s.Start.IsZero() {
+		return 0
+	}
+	if s.End.IsZero() {
+		return time.Since(s.Start)
+	}
+	return s.End.Sub(s.Start)
+}
+
+// counters holds the statistics updated while relaying.
+type counters struct {
+	up        atomic.Int64
+	down      atomic.Int64
+	firstByte atomic.Int64 // Nanoseconds since start
+
+	mu     sync.Mutex
+	start  time.Time
+	end    time.Time
+	reason CloseReason
+}
+
+func (c *counters) begin() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.start = time.Now()
+	return c.start
+}
+
+// done records the end of a direction of the relay, only the first direction to end gives the reason.
+func (c *counters) done(reason CloseReason) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.reason == CloseNone {
+		c.reason = reason
+	}
+}
+
+// finish records the end of the relay.
+func (c *counters) finish() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.end = time.Now()
+}
+
+func (c *counters) stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return Stats{
+		Up:        c.up.Load(),
+		Down:      c.down.Load(),
+		Start:     c.start,
+		End:       c.end,
+		FirstByte: time.Duration(c.firstByte.Load()),
+		Reason:    c.reason,
+	}
+}
+
+// A meter counts the bytes copied in a direction of a relay.
+type meter struct {
+	n     *atomic.Int64
+	first *atomic.Int64 // Records the first copied byte when not nil
+	start time.Time
+}
+
+func (m *meter) add(n int64) {
+	if n <= 0 {
+		return
+	}
+	if m.first != nil && m.first.Load() == 0 {
+		m.first.CompareAndSwap(0, int64(max(time.Since(m.start), 1)))
+	}
+	m.n.Add(n)
+}
+
+// countWriter counts the bytes written to w.
+type countWriter struct {
+	w io.Writer
+	m *meter
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.m.add(int64(n))
+	return n, err
+}
+
+// closeReason returns the reason of a copy ended with err, eof being the reason when the source reached EOF.
+func closeReason(err error, eof CloseReason) CloseReason {
+	if err == nil {
+		return eof
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return CloseTimeout
+	}
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return CloseTimeout
+	}
+	return CloseError
+}